@@ -2,9 +2,17 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"wtt/common"
 	"wtt/common/rtc"
 	"wtt/common/rtc/offerer"
@@ -14,131 +22,800 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
-func Run(ctx context.Context, serverAddr, hostID, localAddr string, protocol common.NetProtocol) <-chan error {
+// Options holds the optional client settings.
+type Options struct {
+	// ICETCP enables gathering of active ICE-TCP candidates.
+	ICETCP bool
+	// ICE holds the STUN/TURN servers, the candidate privacy mode and the ICE
+	// restart grace period.
+	ICE rtc.ICEOptions
+	// Timeouts bounds every phase of establishing the connection.
+	Timeouts rtc.Timeouts
+	// HTTP configures the client used to reach the signaling server.
+	HTTP rtc.HTTPOptions
+	// Certificate is the path of the persistent DTLS certificate. When empty
+	// a new certificate is generated for every connection.
+	Certificate string
+	// KnownHosts is the path of the file pinning host fingerprints. When
+	// empty the fingerprint presented by the host is not checked. Pinning
+	// needs the host to have a persistent certificate too, hosts without one
+	// are refused.
+	KnownHosts string
+	// ReplaceKnownHost accepts a host fingerprint that differs from the one
+	// in KnownHosts, replacing the recorded one.
+	ReplaceKnownHost bool
+	// Flows limits the UDP flows tracked for local source addresses.
+	Flows common.FlowOptions
+	// Reliability is how the data channel of a UDP tunnel delivers
+	// datagrams.
+	Reliability rtc.Reliability
+	// Compression is the codec compressing TCP streams, used when the host
+	// accepts it.
+	Compression common.Codec
+	// Stripes is over how many peer connections to the host every TCP
+	// stream is striped. Zero or one means a single peer connection. Every
+	// peer connection runs ICE with sockets of its own, so they use distinct
+	// candidate pairs, but nothing steers them onto different network paths:
+	// striping adds windows over one path rather than bonding links.
+	Stripes int
+	// Upload and Download limit the rate of the data sent to and received
+	// from the host. Zero means no limit.
+	Upload, Download common.Rate
+	// Priority is the scheduling class of TCP streams.
+	Priority common.Priority
+	// SOCKS, when set, is the address of a SOCKS5 server run instead of
+	// forwarding localAddr. Every SOCKS request asks the host to dial its
+	// destination, which must be in the allow-list of the host. It requires
+	// a TCP session.
+	SOCKS string
+	// HTTPProxy, when set, is the address of an HTTP proxy run instead of
+	// forwarding localAddr, for CONNECT and absolute-URI requests. Its
+	// destinations are subject to the allow-list of the host as with SOCKS.
+	HTTPProxy string
+	// ProxyAuth, when set, is the user:password HTTP proxy clients must
+	// authenticate with.
+	ProxyAuth string
+	// SocketMode is the permission of the unix socket listened on,
+	// common.DefaultSocketMode when zero.
+	SocketMode os.FileMode
+	// Stdio bridges a single stream to the standard input and output of the
+	// process instead of forwarding localAddr, as an SSH ProxyCommand does.
+	Stdio bool
+	// Forwards are more local addresses to forward, each to a service of a
+	// host. Forwards to the same host share its peer connections. They
+	// require a stream protocol.
+	Forwards []Forward
+	// HostOrder is the order in which a comma-separated list of host IDs is
+	// tried, HostOrderOrdered when empty. Streams keep the session they
+	// started on; new ones go to the first host that can be reached once
+	// that session ended.
+	HostOrder HostOrder
+	// Lazy connects to the host only once the first local connection
+	// arrives, and again for the next one after the session ended, instead
+	// of before listening. It requires a stream protocol.
+	Lazy bool
+	// IdleTimeout is after how long without streams a lazy session is torn
+	// down. Zero means never.
+	IdleTimeout time.Duration
+	// RemoteListens ask the host to listen on their remote addresses instead
+	// of forwarding localAddr, and bridge the connections it accepts there
+	// to their local addresses. The addresses must be allowed by the host. A
+	// packet session carries a single remote listen.
+	RemoteListens []RemoteListen
+	// Target, when set, is the host:port the host dials for the connections
+	// to localAddr, or for the stream of Stdio, instead of its local service.
+	// It must be allowed by the allow-list of the host, which refuses it
+	// otherwise. It requires a stream protocol.
+	Target string
+}
+
+// Forward forwards the connections to a local address to a service of a host.
+type Forward struct {
+	// Local is the address listened on.
+	Local string
+	// Host is the ID of the host, or a comma-separated list of host IDs to
+	// fail over between.
+	Host string
+	// Service names the service of the host, its default local service when
+	// empty.
+	Service string
+	// Target, when set, is the destination the host dials instead of a
+	// service.
+	Target string
+}
+
+// ParseForward parses a forward of the form local=host[/service].
+func ParseForward(s string) (Forward, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return Forward{}, fmt.Errorf("invalid forward %q: want local=host[/service]", s)
+	}
+	f := Forward{Local: s[:i]}
+	f.Host, f.Service, _ = strings.Cut(s[i+1:], "/")
+	if f.Local == "" || f.Host == "" {
+		return Forward{}, fmt.Errorf("invalid forward %q: want local=host[/service]", s)
+	}
+	return f, nil
+}
+
+// RemoteListen bridges the connections a host accepts on an address of its
+// own to a local address.
+type RemoteListen struct {
+	// Remote is the address the host listens on.
+	Remote string
+	// Local is the address dialed for every connection.
+	Local string
+}
+
+// ParseRemoteListen parses a remote listen of the form remote=local.
+func ParseRemoteListen(s string) (RemoteListen, error) {
+	remote, local, ok := strings.Cut(s, "=")
+	if !ok || remote == "" || local == "" {
+		return RemoteListen{}, fmt.Errorf("invalid remote listen %q: want remote=local", s)
+	}
+	return RemoteListen{Remote: remote, Local: local}, nil
+}
+
+func Run(ctx context.Context, serverAddr, hostID, localAddr string, protocol common.NetProtocol, opts Options) <-chan error {
 	ec := make(chan error)
 
 	go func() {
-		pcCfg := webrtc.Configuration{}
-		pc, err := offerer.A_CreatePeerConnection(pcCfg)
-		if err != nil {
-			ec <- err
+		if opts.Stripes < 0 || opts.Stripes > common.MaxStripes {
+			ec <- fmt.Errorf("invalid number of stripes %d: must be from 0 to %d", opts.Stripes, common.MaxStripes)
 			return
 		}
-		defer pc.Close()
-
-		id, err := uuid.NewRandom()
-		if err != nil {
-			ec <- err
+		if _, err := opts.Reliability.Init(); err != nil {
+			ec <- fmt.Errorf("invalid UDP reliability: %w", err)
 			return
 		}
-		dc, err := offerer.B_CreateDataChannel(pc, id.String())
-		if err != nil {
-			ec <- err
+		if (opts.SOCKS != "" || opts.HTTPProxy != "") && protocol != common.TCP {
+			ec <- errors.New("SOCKS and HTTP proxy modes require a tcp session")
 			return
 		}
-		defer dc.Close()
-
-		dcOpen := make(chan struct{}, 1)
-		dc.OnOpen(func() { dcOpen <- struct{}{} })
-
-		ofCfg := webrtc.OfferOptions{}
-		of, err := offerer.C_CreateOffer(pc, ofCfg)
-		if err != nil {
-			ec <- err
+		if len(opts.Forwards) > 0 && !protocol.Stream() {
+			ec <- errors.New("forwards require a stream protocol")
 			return
 		}
-
-		slog.Debug("setting local description")
-		if err := offerer.D_SetOfferAsLocalDescription(pc, *of); err != nil {
-			ec <- err
+		if opts.Lazy && !protocol.Stream() {
+			ec <- errors.New("lazy mode requires a stream protocol")
 			return
 		}
-
-		<-webrtc.GatheringCompletePromise(pc)
-		ld := pc.LocalDescription()
-		if ld == nil {
-			ec <- webrtc.ErrConnectionClosed
+		if opts.Stdio && !protocol.Stream() {
+			ec <- errors.New("stdio mode requires a stream protocol")
+			return
+		}
+		if len(opts.RemoteListens) > 1 && !protocol.Stream() {
+			ec <- errors.New("a packet session carries a single remote listen")
+			return
+		}
+		if opts.Target != "" && !protocol.Stream() {
+			ec <- errors.New("target mode requires a stream protocol")
+			return
+		}
+		if opts.Target != "" && (opts.SOCKS != "" || opts.HTTPProxy != "") {
+			ec <- errors.New("SOCKS and HTTP proxy modes choose their own targets")
+			return
+		}
+		if len(opts.RemoteListens) > 0 && opts.Lazy {
+			ec <- errors.New("remote listens cannot be lazy")
 			return
 		}
 
-		hc := resty.New().SetBaseURL(serverAddr)
+		se := webrtc.SettingEngine{}
+		if opts.ICETCP {
+			rtc.EnableActiveICETCP(&se)
+		}
 
-		slog.Debug("sending offer")
-		if err := rtc.SendRTCEvent(hc, common.RTCOfferType, hostID, *ld); err != nil {
+		pcCfg := webrtc.Configuration{}
+		if err := opts.ICE.Configure(&pcCfg, &se); err != nil {
 			ec <- err
 			return
 		}
+		if opts.Certificate != "" {
+			if err := rtc.UseCertificate(&pcCfg, opts.Certificate); err != nil {
+				ec <- err
+				return
+			}
+		}
 
-		slog.Debug("waiting for answer")
-		answer, err := rtc.ReceiveRTCEvent(hc, common.RTCAnswerType, hostID)
+		hc, err := rtc.NewHTTPClient(serverAddr, opts.HTTP)
 		if err != nil {
 			ec <- err
 			return
 		}
-		slog.Debug("setting remote description")
-		if err := offerer.E_SetAnswerAsRemoteDescription(pc, *answer); err != nil {
-			ec <- err
-			return
+
+		slog.Info("start bridging", "protocol", protocol, "local", localAddr, "target", opts.Target, "socks", opts.SOCKS, "http-proxy", opts.HTTPProxy)
+		if protocol.Stream() && opts.Compression != "" && opts.Compression != common.CodecNone {
+			rctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go common.ReportCompression(rctx)
+		}
+		limits := common.Shaper{
+			Upload:   common.NewLimiter(opts.Upload),
+			Download: common.NewLimiter(opts.Download),
 		}
 
-		slog.Debug("waiting for data channel to open")
-		select {
-		case <-dcOpen:
-			slog.Info("start bridging", "protocol", protocol, "local", localAddr)
+		switch protocol {
+		case common.TCP, common.Unix:
+			// Streams to the same host share its session.
+			sessions := map[string]*session{}
+			sessionFor := func(hostID string) *session {
+				if sess, ok := sessions[hostID]; ok {
+					return sess
+				}
+				hosts := strings.Split(hostID, ",")
+				sess := newSession(func(ctx context.Context) ([]*peer, common.ChannelSpec, error) {
+					return connectAny(ctx, hosts, opts.HostOrder, func(ctx context.Context, hostID string) ([]*peer, common.ChannelSpec, error) {
+						return connectPeers(ctx, pcCfg, se, hc, hostID, protocol, opts)
+					})
+				}, opts.Lazy && !opts.Stdio, len(hosts) > 1, opts.IdleTimeout)
+				sessions[hostID] = sess
+				return sess
+			}
+			defer func() {
+				for _, sess := range sessions {
+					sess.close()
+				}
+			}()
 
-			switch protocol {
-			case common.TCP:
-				l, err := net.Listen("tcp", localAddr)
+			if opts.Stdio {
+				peers, spec, err := sessionFor(hostID).acquire(ctx)
 				if err != nil {
-					ec <- fmt.Errorf("client failed to listen on local port: %w", err)
+					ec <- err
 					return
 				}
-				defer l.Close()
+				ec <- bridgeStdio(ctx, peers, spec, limits, opts)
+				return
+			}
+			if len(opts.RemoteListens) > 0 {
+				ec <- serveRemoteListens(ctx, sessionFor(hostID), protocol, limits, opts)
+				return
+			}
 
-				slog.Info("client listening for local connections", "addr", l.Addr())
+			var listeners []listener
+			switch {
+			case opts.SOCKS != "":
+				listeners = append(listeners, listener{addr: opts.SOCKS, sess: sessionFor(hostID), handle: func(conn net.Conn, peers []*peer, spec common.ChannelSpec) {
+					serveSOCKS(ctx, peers, conn, spec, limits, opts)
+				}})
+			case opts.HTTPProxy != "":
+				listeners = append(listeners, listener{addr: opts.HTTPProxy, sess: sessionFor(hostID), handle: func(conn net.Conn, peers []*peer, spec common.ChannelSpec) {
+					serveHTTPProxy(ctx, peers, conn, spec, limits, opts)
+				}})
+			default:
+				forwards := opts.Forwards
+				if localAddr != "" {
+					forwards = append([]Forward{{Local: localAddr, Host: hostID, Target: opts.Target}}, forwards...)
+				}
+				for _, f := range forwards {
+					listeners = append(listeners, listener{addr: f.Local, sess: sessionFor(f.Host), handle: func(conn net.Conn, peers []*peer, spec common.ChannelSpec) {
+						spec.Service = f.Service
+						spec.Target = f.Target
+						forward(ctx, peers, conn, spec, limits, opts)
+					}})
+				}
+			}
+			ec <- serveListeners(ctx, listeners, protocol, opts.socketMode())
 
-				// Accept one connection
-				conn, err := l.Accept()
-				if err != nil {
-					// if context is cancelled, this is expected
-					if ctx.Err() == nil {
-						ec <- fmt.Errorf("client failed to accept connection: %w", err)
+		case common.UDP, common.Unixgram:
+			var p *peer
+			err := retry(ctx, func() error {
+				_, _, err := connectAny(ctx, strings.Split(hostID, ","), opts.HostOrder, func(ctx context.Context, hostID string) ([]*peer, common.ChannelSpec, error) {
+					var err error
+					p, err = connect(ctx, pcCfg, se, hc, hostID, "", protocol, opts)
+					return nil, common.ChannelSpec{}, err
+				})
+				return err
+			}, nil)
+			if err != nil {
+				ec <- err
+				return
+			}
+			defer p.pc.Close()
+
+			if len(opts.RemoteListens) > 0 {
+				// The datagrams the host receives on the remote address come
+				// as flows, each sent from a socket of its own.
+				local := opts.RemoteListens[0].Local
+				slog.Info("host listening for remote datagrams", "remote", opts.RemoteListens[0].Remote, "local", local)
+				dial := func() (net.Conn, error) {
+					if protocol == common.Unixgram {
+						return common.DialUnixgram(local, opts.socketMode())
 					}
-					return
+					return net.Dial("udp", local)
 				}
+				ec <- <-common.BridgeFlows(p.ch, dial, opts.Flows, &limits)
+				return
+			}
 
-				bridgeErrCh := common.BridgeStream(dc, conn)
-				if err := <-bridgeErrCh; err != nil {
-					slog.Error("bridge finished with error", "err", err)
-					ec <- err
-				} else {
-					slog.Debug("bridge finished cleanly")
-					ec <- nil
-				}
+			// Datagrams of every local source address share the data
+			// channel, each as a flow of its own.
+			conn, err := common.ListenPacket(protocol, localAddr, opts.socketMode())
+			if err != nil {
+				ec <- fmt.Errorf("client failed to listen on local %s: %w", protocol, err)
+				return
+			}
+			bridgeErrCh := common.BridgePacket(p.ch, conn, opts.Flows, &limits)
+			if err := <-bridgeErrCh; err != nil {
+				slog.Error("udp bridge finished with error", "err", err)
+				ec <- err
+			} else {
+				ec <- nil
+			}
+		}
+	}()
 
-			case common.UDP:
-				// UDP logic for the client is more complex as it doesn't have a clear "accept" model.
-				// For now, we'll assume the same ListenPacket logic as the host is sufficient,
-				// though a real-world scenario might need more sophisticated handling.
-				conn, err := net.ListenPacket("udp", localAddr)
-				if err != nil {
-					ec <- fmt.Errorf("client failed to listen on local udp: %w", err)
+	return ec
+}
+
+func (o Options) socketMode() os.FileMode {
+	if o.SocketMode == 0 {
+		return common.DefaultSocketMode
+	}
+	return o.SocketMode
+}
+
+// peer is an established peer connection to the host.
+type peer struct {
+	pc *webrtc.PeerConnection
+	// ch is the open first data channel: the control channel of a stream
+	// session or the data channel of a packet session.
+	ch *common.Channel
+	// closed is closed once pc is closed.
+	closed <-chan struct{}
+	// scheduler schedules the streams of pc.
+	scheduler *common.Scheduler
+	// codecs are the compression codecs the host accepts.
+	codecs []common.Codec
+	// incoming receives the data channels the host opens for the
+	// connections accepted on remote listens.
+	incoming <-chan *common.Channel
+	// session is the ID pc was negotiated under.
+	session string
+}
+
+// HostOrder is the order in which the hosts of a failover list are tried.
+type HostOrder string
+
+const (
+	HostOrderOrdered HostOrder = "ordered"
+	HostOrderRandom  HostOrder = "random"
+)
+
+// connectAny connects with connect to the first of hosts that can be
+// reached, trying them in order.
+func connectAny(ctx context.Context, hosts []string, order HostOrder, connect func(ctx context.Context, hostID string) ([]*peer, common.ChannelSpec, error)) ([]*peer, common.ChannelSpec, error) {
+	if len(hosts) == 1 {
+		return connect(ctx, hosts[0])
+	}
+	if order == HostOrderRandom {
+		hosts = slices.Clone(hosts)
+		rand.Shuffle(len(hosts), func(i, j int) { hosts[i], hosts[j] = hosts[j], hosts[i] })
+	}
+
+	var errs []error
+	for _, id := range hosts {
+		peers, spec, err := connect(ctx, id)
+		if err == nil {
+			slog.Info("connected to host", "id", id)
+			return peers, spec, nil
+		}
+		if ctx.Err() != nil {
+			return nil, spec, ctx.Err()
+		}
+		slog.Warn("host unavailable, trying the next one", "id", id, "err", err)
+		errs = append(errs, fmt.Errorf("host %s: %w", id, err))
+	}
+	return nil, common.ChannelSpec{}, errors.Join(errs...)
+}
+
+// connectPeers connects the peer connections of a stream session, as many as
+// streams are striped over, and returns them with the spec of its streams.
+func connectPeers(ctx context.Context, pcCfg webrtc.Configuration, se webrtc.SettingEngine, hc *resty.Client, hostID string, protocol common.NetProtocol, opts Options) ([]*peer, common.ChannelSpec, error) {
+	p, err := connect(ctx, pcCfg, se, hc, hostID, "", protocol, opts)
+	if err != nil {
+		return nil, common.ChannelSpec{}, err
+	}
+
+	spec := common.ChannelSpec{Codec: common.CodecNone, Priority: opts.Priority}
+	if opts.Compression != "" && opts.Compression != common.CodecNone {
+		if slices.Contains(p.codecs, opts.Compression) {
+			spec.Codec = opts.Compression
+		} else {
+			slog.Warn("host does not accept the compression codec, streams are not compressed", "codec", opts.Compression, "accepted", p.codecs)
+		}
+	}
+
+	// Bond more peer connections to stripe streams over.
+	peers := []*peer{p}
+	for i := 1; i < opts.Stripes; i++ {
+		bp, err := connect(ctx, pcCfg, se, hc, hostID, p.session, protocol, opts)
+		if err != nil {
+			closePeers(peers)
+			return nil, spec, fmt.Errorf("connect stripe %d: %w", i, err)
+		}
+		peers = append(peers, bp)
+	}
+	return peers, spec, nil
+}
+
+func closePeers(peers []*peer) {
+	for _, p := range peers {
+		if err := p.pc.Close(); err != nil {
+			slog.Error("failed to close peer connection", "err", err)
+		}
+	}
+}
+
+// connect establishes a new session with the host, restarting its ICE
+// connection whenever it is lost. A non-empty bond is the session the new one
+// is bonded to, whose streams it carries stripes of.
+func connect(ctx context.Context, pcCfg webrtc.Configuration, se webrtc.SettingEngine, hc *resty.Client, hostID, bond string, protocol common.NetProtocol, opts Options) (_ *peer, err error) {
+	pc, err := offerer.A_CreatePeerConnection(pcCfg, se)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			pc.Close()
+		}
+	}()
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	// Stream sessions carry a data channel per connection next to the
+	// control channel, packet sessions a single data channel.
+	label := common.ControlLabel
+	var init *webrtc.DataChannelInit
+	if !protocol.Stream() {
+		label = id.String()
+		if init, err = opts.Reliability.Init(); err != nil {
+			return nil, err
+		}
+		if len(opts.RemoteListens) > 0 {
+			if init == nil {
+				init = &webrtc.DataChannelInit{}
+			}
+			protocol := common.ChannelSpec{Listen: opts.RemoteListens[0].Remote}.Encode()
+			init.Protocol = &protocol
+		}
+	}
+	dc, err := offerer.B_CreateDataChannel(pc, label, init)
+	if err != nil {
+		return nil, err
+	}
+	ch := common.NewChannel(dc)
+
+	answer, err := negotiate(ctx, pc, hc, hostID, id.String(), bond, webrtc.OfferOptions{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("waiting for ICE connection")
+	if err := rtc.WaitConnected(ctx, pc, opts.Timeouts.ICE); err != nil {
+		return nil, fmt.Errorf("connect to host %q: %w", hostID, err)
+	}
+
+	var restarting atomic.Bool
+	var onLost func()
+	if opts.ICE.RestartGrace > 0 {
+		onLost = func() {
+			if !restarting.CompareAndSwap(false, true) {
+				return
+			}
+			defer restarting.Store(false)
+
+			slog.Info("restarting ICE", "hostID", hostID)
+			if _, err := negotiate(ctx, pc, hc, hostID, id.String(), bond, webrtc.OfferOptions{ICERestart: true}, opts); err != nil {
+				slog.Error("ICE restart error", "err", err)
+			}
+		}
+	}
+	closed := rtc.MonitorICE(pc, opts.ICE.RestartGrace, onLost)
+
+	var incoming chan *common.Channel
+	if protocol.Stream() && len(opts.RemoteListens) > 0 {
+		incoming = make(chan *common.Channel, 16)
+		pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+			select {
+			case incoming <- common.NewChannel(dc):
+			case <-closed:
+			}
+		})
+	}
+
+	slog.Debug("waiting for data channel to open")
+	octx, cancel := rtc.WithTimeout(ctx, opts.Timeouts.Open)
+	defer cancel()
+	select {
+	case <-ch.Opened():
+	case <-octx.Done():
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, rtc.PhaseError("data channel open", opts.Timeouts.Open, octx.Err())
+	}
+
+	return &peer{pc: pc, ch: ch, closed: closed, scheduler: common.NewScheduler(), codecs: answer.Codecs, incoming: incoming, session: id.String()}, nil
+}
+
+// negotiate runs one offer/answer exchange with the host through the
+// signaling server, either to establish pc or to restart its ICE connection.
+func negotiate(ctx context.Context, pc *webrtc.PeerConnection, hc *resty.Client, hostID, session, bond string, ofCfg webrtc.OfferOptions, opts Options) (*common.RTCSignal, error) {
+	of, err := offerer.C_CreateOffer(pc, ofCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("setting local description")
+	if err := offerer.D_SetOfferAsLocalDescription(pc, *of); err != nil {
+		return nil, err
+	}
+
+	if err := rtc.Gather(ctx, pc, opts.Timeouts.Gather); err != nil {
+		return nil, err
+	}
+	ld, err := rtc.LocalSignal(pc, opts.ICE.Privacy)
+	if err != nil {
+		return nil, err
+	}
+	ld.Session = session
+	ld.Bond = bond
+
+	sctx, cancel := rtc.WithTimeout(ctx, opts.Timeouts.Signal)
+	defer cancel()
+
+	slog.Debug("sending offer")
+	if err := rtc.SendRTCEvent(sctx, hc, common.RTCOfferType, hostID, ld); err != nil {
+		return nil, rtc.PhaseError("sending offer", opts.Timeouts.Signal, err)
+	}
+
+	slog.Debug("waiting for answer")
+	answer, err := rtc.ReceiveRTCEvent(sctx, hc, common.RTCAnswerType, hostID, session)
+	if err != nil {
+		return nil, rtc.PhaseError("waiting for answer", opts.Timeouts.Signal, err)
+	}
+	if answer.Session != session {
+		return nil, fmt.Errorf("received the answer of session %q instead of %q", answer.Session, session)
+	}
+	slog.Info("received answer", "hostID", hostID, "privacy", answer.Privacy)
+
+	if opts.KnownHosts != "" {
+		if !answer.PersistentCert {
+			return nil, fmt.Errorf("%w: host %q changes its fingerprint every connection, start it with --certificate", rtc.ErrUnpinnableHost, hostID)
+		}
+		fingerprint, err := rtc.RemoteFingerprint(answer.SessionDescription)
+		if err != nil {
+			return nil, err
+		}
+		if err := rtc.CheckKnownHost(opts.KnownHosts, hostID, fingerprint, opts.ReplaceKnownHost); err != nil {
+			return nil, err
+		}
+	}
+
+	slog.Debug("setting remote description")
+	if err := offerer.E_SetAnswerAsRemoteDescription(pc, answer.SessionDescription); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// listener is a local address whose connections are passed to handle with
+// the peers of sess.
+type listener struct {
+	addr   string
+	sess   *session
+	handle func(conn net.Conn, peers []*peer, spec common.ChannelSpec)
+}
+
+// serveListeners serves all listeners until ctx is done or every one of them
+// failed. A listener fails alone, when it cannot listen or its eager session
+// ended; connecting it to its host is retried.
+func serveListeners(ctx context.Context, listeners []listener, network common.NetProtocol, mode os.FileMode) error {
+	errs := make([]error, len(listeners))
+	var wg sync.WaitGroup
+	for i, l := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !l.sess.lazy {
+				// The session is held for as long as the client runs.
+				if _, _, err := l.sess.acquireRetrying(ctx); err != nil {
+					errs[i] = err
+					slog.Error("forward failed", "local", l.addr, "err", err)
 					return
 				}
-				bridgeErrCh := common.BridgePacket(dc, conn)
-				if err := <-bridgeErrCh; err != nil {
-					slog.Error("udp bridge finished with error", "err", err)
-					ec <- err
-				} else {
-					ec <- nil
-				}
 			}
-			return
+			errs[i] = serveStreams(ctx, l.sess, network, l.addr, mode, l.handle)
+			if ctx.Err() == nil {
+				slog.Error("forward failed", "local", l.addr, "err", errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.Join(errs...)
+}
+
+// serveStreams accepts local connections of network on localAddr, a unix
+// socket created with mode, and passes each of them to handle with the peers
+// of sess, until ctx is done or an eager session ends.
+func serveStreams(ctx context.Context, sess *session, network common.NetProtocol, localAddr string, mode os.FileMode, handle func(conn net.Conn, peers []*peer, spec common.ChannelSpec)) error {
+	l, err := common.Listen(network, localAddr, mode)
+	if err != nil {
+		return fmt.Errorf("client failed to listen on local port: %w", err)
+	}
+	defer l.Close()
+
+	slog.Info("client listening for local connections", "addr", l.Addr(), "lazy", sess.lazy)
+	defer func() {
+		if stats := common.Compression(); stats != (common.CompressionStats{}) {
+			slog.Info("compression totals", "stats", stats)
+		}
+	}()
+
+	stop := make(chan error, 1)
+	go func() {
+		// Stop accepting once the session is over.
+		select {
 		case <-ctx.Done():
-			ec <- ctx.Err()
-			return
+			stop <- ctx.Err()
+		case <-sess.ended:
+			stop <- sess.err
 		}
+		l.Close()
 	}()
 
-	return ec
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case err := <-stop:
+				return err
+			default:
+				return fmt.Errorf("client failed to accept connection: %w", err)
+			}
+		}
+
+		go func() {
+			peers, spec, err := sess.acquire(ctx)
+			if err != nil {
+				slog.Error("failed to connect to host", "err", err)
+				conn.Close()
+				return
+			}
+			defer sess.release()
+			handle(conn, peers, spec)
+		}()
+	}
+}
+
+// forward bridges the local connection conn over new data channels opened
+// with spec, one on every peer, within the rate limits of limits. A stream to
+// a target is bridged once the host dialed it.
+func forward(ctx context.Context, peers []*peer, conn net.Conn, spec common.ChannelSpec, limits common.Shaper, opts Options) {
+	var ch common.MessageChannel
+	var err error
+	if spec.Target != "" {
+		ch, err = openTarget(ctx, peers, spec, spec.Target, opts)
+	} else {
+		ch, err = openStream(ctx, peers, spec, opts)
+	}
+	var reset *common.ResetError
+	if errors.As(err, &reset) {
+		slog.Error("host refused the stream", "target", spec.Target, "reason", reset.Reason)
+		conn.Close()
+		return
+	}
+	if err != nil {
+		slog.Error("failed to open stream", "err", err)
+		conn.Close()
+		return
+	}
+	bridgeStream(ch, conn, peers, spec, limits)
+}
+
+// bridgeStdio bridges a new stream to the standard input and output until the
+// stream is done or ctx is.
+func bridgeStdio(ctx context.Context, peers []*peer, spec common.ChannelSpec, limits common.Shaper, opts Options) error {
+	var ch common.MessageChannel
+	var err error
+	if opts.Target != "" {
+		ch, err = openTarget(ctx, peers, spec, opts.Target, opts)
+	} else {
+		ch, err = openStream(ctx, peers, spec, opts)
+	}
+	if err != nil {
+		return err
+	}
+	shaper := limits
+	shaper.Scheduler = peers[0].scheduler
+	shaper.Priority = spec.Priority
+	select {
+	case err := <-common.BridgeStdio(ch, os.Stdin, os.Stdout, &shaper):
+		return err
+	case <-ctx.Done():
+		ch.Close()
+		return ctx.Err()
+	}
+}
+
+// bridgeStream bridges conn over the stream channel ch within the rate limits
+// of limits.
+func bridgeStream(ch common.MessageChannel, conn net.Conn, peers []*peer, spec common.ChannelSpec, limits common.Shaper) {
+	shaper := limits
+	shaper.Scheduler = peers[0].scheduler
+	shaper.Priority = spec.Priority
+	if err := <-common.BridgeStream(ch, conn, &shaper); err != nil {
+		slog.Error("bridge finished with error", "label", ch.Label(), "err", err)
+	} else {
+		slog.Debug("bridge finished cleanly", "label", ch.Label())
+	}
+}
+
+// openTarget opens a stream with spec to target, which the host dials, and
+// waits until it did.
+func openTarget(ctx context.Context, peers []*peer, spec common.ChannelSpec, target string, opts Options) (common.MessageChannel, error) {
+	spec.Target, spec.Network = target, common.TCP
+	ch, err := openStream(ctx, peers, spec, opts)
+	if err != nil {
+		return nil, err
+	}
+	ready, err := common.AwaitStream(ch)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return ready, nil
+}
+
+// openStream opens the data channels of a new stream with spec, one on every
+// peer, and waits for them to open.
+func openStream(ctx context.Context, peers []*peer, spec common.ChannelSpec, opts Options) (common.MessageChannel, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("create data channel label: %w", err)
+	}
+
+	chs := make([]*common.Channel, 0, len(peers))
+	closeAll := func() {
+		for _, ch := range chs {
+			ch.Close()
+		}
+	}
+	for i, p := range peers {
+		label := id.String()
+		if len(peers) > 1 {
+			label = fmt.Sprintf("%s/%d", id, i)
+			spec.Group, spec.Stripe, spec.Stripes = id.String(), i, len(peers)
+		}
+		protocol := spec.Encode()
+		dc, err := offerer.B_CreateDataChannel(p.pc, label, &webrtc.DataChannelInit{Protocol: &protocol})
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("create data channel: %w", err)
+		}
+		chs = append(chs, common.NewChannel(dc))
+	}
+
+	octx, cancel := rtc.WithTimeout(ctx, opts.Timeouts.Open)
+	defer cancel()
+	for _, ch := range chs {
+		select {
+		case <-ch.Opened():
+		case <-octx.Done():
+			closeAll()
+			return nil, rtc.PhaseError("data channel open", opts.Timeouts.Open, octx.Err())
+		}
+	}
+
+	if len(chs) > 1 {
+		return common.NewStriped(chs), nil
+	}
+	return chs[0], nil
 }
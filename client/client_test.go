@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"wtt/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectAny(t *testing.T) {
+	errs := map[string]error{
+		"host-a": errors.New("ICE connection did not complete"),
+		"host-b": errors.New("sending offer: 500"),
+	}
+	var tried []string
+	connect := func(ctx context.Context, hostID string) ([]*peer, common.ChannelSpec, error) {
+		tried = append(tried, hostID)
+		if err := errs[hostID]; err != nil {
+			return nil, common.ChannelSpec{}, err
+		}
+		return []*peer{{session: hostID}}, common.ChannelSpec{Group: hostID}, nil
+	}
+
+	// Hosts are tried in order until one can be reached.
+	peers, spec, err := connectAny(context.Background(), []string{"host-a", "host-b", "host-c", "host-d"}, HostOrderOrdered, connect)
+	require.NoError(t, err)
+	require.Equal(t, "host-c", peers[0].session)
+	require.Equal(t, "host-c", spec.Group)
+	require.Equal(t, []string{"host-a", "host-b", "host-c"}, tried)
+
+	// When none can be, the error of every host is reported.
+	tried = nil
+	_, _, err = connectAny(context.Background(), []string{"host-a", "host-b"}, HostOrderOrdered, connect)
+	require.ErrorIs(t, err, errs["host-a"])
+	require.ErrorIs(t, err, errs["host-b"])
+	require.ErrorContains(t, err, "host host-a: ")
+	require.ErrorContains(t, err, "host host-b: ")
+
+	// A random order still tries every host once.
+	tried = nil
+	_, _, err = connectAny(context.Background(), []string{"host-a", "host-b"}, HostOrderRandom, connect)
+	require.Error(t, err)
+	slices.Sort(tried)
+	require.Equal(t, []string{"host-a", "host-b"}, tried)
+
+	// Failing over stops once ctx is done.
+	tried = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = connectAny(ctx, []string{"host-a", "host-b"}, HostOrderOrdered, connect)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, []string{"host-a"}, tried)
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"wtt/common"
+)
+
+// proxyHandshakeTimeout bounds reading the request of an HTTP proxy
+// connection.
+const proxyHandshakeTimeout = 30 * time.Second
+
+// serveHTTPProxy serves the HTTP proxy connection conn. A CONNECT request is
+// bridged over a new stream whose host side dials the requested destination,
+// an absolute-URI request is sent to its origin server over such a stream,
+// which then carries the response back.
+func serveHTTPProxy(ctx context.Context, peers []*peer, conn net.Conn, spec common.ChannelSpec, limits common.Shaper, opts Options) {
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	r := bufio.NewReader(conn)
+
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		slog.Warn("HTTP proxy failed to read request", "from", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	if !proxyAuthorized(req, opts.ProxyAuth) {
+		slog.Warn("HTTP proxy request not authorized", "from", conn.RemoteAddr())
+		writeProxyError(conn, req, http.StatusProxyAuthRequired)
+		conn.Close()
+		return
+	}
+
+	var target string
+	switch {
+	case req.Method == http.MethodConnect:
+		target = req.Host
+	case req.URL.Scheme == "http" && req.URL.Host != "":
+		target = req.URL.Host
+		if req.URL.Port() == "" {
+			target = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	default:
+		// Origin-form requests are meant for a server, not a proxy, and
+		// https has to be tunneled with CONNECT.
+		writeProxyError(conn, req, http.StatusBadRequest)
+		conn.Close()
+		return
+	}
+
+	slog.Debug("HTTP proxy request", "from", conn.RemoteAddr(), "method", req.Method, "target", target)
+	ch, err := openTarget(ctx, peers, spec, target, opts)
+	if err != nil {
+		slog.Warn("HTTP proxy failed to reach target", "target", target, "err", err)
+		writeProxyError(conn, req, proxyStatus(err))
+		conn.Close()
+		return
+	}
+
+	var local net.Conn
+	if req.Method == http.MethodConnect {
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			ch.Close()
+			conn.Close()
+			return
+		}
+		// Data the client sent right after its request may already be
+		// buffered in r.
+		local = &readerConn{conn, r}
+	} else {
+		// Forward the request in origin form, followed by anything the
+		// client sends after it. The origin server closes the connection
+		// after its response, as the proxy cannot tell where it ends.
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Proxy-Connection")
+		req.Close = true
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(req.Write(pw)) }()
+		local = &readerConn{conn, io.MultiReader(pr, r)}
+	}
+	conn.SetDeadline(time.Time{})
+	bridgeStream(ch, local, peers, spec, limits)
+}
+
+// proxyAuthorized reports whether req carries the basic credentials auth, a
+// user:password pair, or whether auth is empty.
+func proxyAuthorized(req *http.Request, auth string) bool {
+	if auth == "" {
+		return true
+	}
+	scheme, creds, ok := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	got, err := base64.StdEncoding.DecodeString(strings.TrimSpace(creds))
+	return err == nil && subtle.ConstantTimeCompare(got, []byte(auth)) == 1
+}
+
+// proxyStatus returns the status for the failure to reach a target err.
+func proxyStatus(err error) int {
+	var reset *common.ResetError
+	if !errors.As(err, &reset) {
+		return http.StatusBadGateway
+	}
+	switch reset.Code {
+	case common.ResetNotAllowed:
+		return http.StatusForbidden
+	case common.ResetTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// writeProxyError answers req with status, closing the connection.
+func writeProxyError(w io.Writer, req *http.Request, status int) error {
+	resp := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header:     http.Header{},
+		Close:      true,
+	}
+	if status == http.StatusProxyAuthRequired {
+		resp.Header.Set("Proxy-Authenticate", `Basic realm="wtt"`)
+	}
+	return resp.Write(w)
+}
+
+// readerConn is a connection whose data is read from r.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the connection, so that bridges pass on the end of
+// the remote stream.
+func (c *readerConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// SetLinger sets the linger of the connection, so that bridges pass on a
+// reset of the remote stream.
+func (c *readerConn) SetLinger(sec int) error {
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		return tc.SetLinger(sec)
+	}
+	return nil
+}
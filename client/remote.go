@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"wtt/common"
+	"wtt/common/rtc"
+	"wtt/common/rtc/offerer"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// serveRemoteListens asks the host of sess to listen on the remote address of
+// every remote listen and bridges the connections it accepts there to dials
+// of their local addresses of network, until ctx is done or the session
+// ended. Connecting is retried, and a session failing over between hosts asks
+// the next host once it ended, unless a host refused to listen.
+func serveRemoteListens(ctx context.Context, sess *session, network common.NetProtocol, limits common.Shaper, opts Options) error {
+	for {
+		peers, _, err := sess.acquireRetrying(ctx)
+		if err != nil {
+			return err
+		}
+		err = serveRemoteListensOn(ctx, sess, peers, network, limits, opts)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var reset *common.ResetError
+		if !sess.reconnect || errors.As(err, &reset) {
+			return err
+		}
+		slog.Warn("remote listens ended, connecting again", "err", err)
+	}
+}
+
+// serveRemoteListensOn serves the remote listens over peers, the connections
+// of sess acquired for them, until they end.
+func serveRemoteListensOn(ctx context.Context, sess *session, peers []*peer, network common.NetProtocol, limits common.Shaper, opts Options) error {
+	defer sess.release()
+	// The connections are not used again once the remote listens ended.
+	defer sess.drop(peers)
+
+	// The host opens the data channels of accepted connections on the peer
+	// connection the listen was asked for on.
+	p := peers[0]
+	locals := map[string]string{}
+	ended := make(chan error, len(opts.RemoteListens))
+	for _, l := range opts.RemoteListens {
+		ch, err := openRemoteListen(ctx, p, l.Remote, opts)
+		if err != nil {
+			return fmt.Errorf("remote listen on %s: %w", l.Remote, err)
+		}
+		defer ch.Close()
+		locals[l.Remote] = l.Local
+		slog.Info("host listening for remote connections", "remote", l.Remote, "local", l.Local)
+
+		go func() {
+			ch.Wait()
+			ended <- fmt.Errorf("remote listen on %s closed by host", l.Remote)
+		}()
+	}
+
+	for {
+		select {
+		case ch := <-p.incoming:
+			go acceptRemote(ctx, ch, locals, network, p, limits, opts)
+		case err := <-ended:
+			return err
+		case <-p.closed:
+			return webrtc.ErrConnectionClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// openRemoteListen asks the host of p to listen on remote and waits until it
+// does. The host stops listening once the returned channel is closed.
+func openRemoteListen(ctx context.Context, p *peer, remote string, opts Options) (*common.Channel, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("create data channel label: %w", err)
+	}
+	protocol := common.ChannelSpec{Listen: remote}.Encode()
+	dc, err := offerer.B_CreateDataChannel(p.pc, id.String(), &webrtc.DataChannelInit{Protocol: &protocol})
+	if err != nil {
+		return nil, fmt.Errorf("create data channel: %w", err)
+	}
+	ch := common.NewChannel(dc)
+
+	octx, cancel := rtc.WithTimeout(ctx, opts.Timeouts.Open)
+	defer cancel()
+	select {
+	case <-ch.Opened():
+	case <-octx.Done():
+		ch.Close()
+		return nil, rtc.PhaseError("data channel open", opts.Timeouts.Open, octx.Err())
+	}
+	if _, err := common.AwaitStream(ch); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// acceptRemote bridges ch, opened by the host for a connection accepted on a
+// remote listen, to a new connection of network to the local address of that
+// listen in locals.
+func acceptRemote(ctx context.Context, ch *common.Channel, locals map[string]string, network common.NetProtocol, p *peer, limits common.Shaper, opts Options) {
+	octx, cancel := rtc.WithTimeout(ctx, opts.Timeouts.Open)
+	defer cancel()
+	select {
+	case <-ch.Opened():
+	case <-p.closed:
+		return
+	case <-octx.Done():
+		ch.Close()
+		return
+	}
+	cancel()
+
+	spec, err := ch.Spec()
+	local, ok := locals[spec.Listen]
+	if err == nil && !ok {
+		err = fmt.Errorf("no remote listen on %q", spec.Listen)
+	}
+	var conn net.Conn
+	if err == nil {
+		conn, err = net.Dial(string(network), local)
+	}
+	if err != nil {
+		slog.Error("failed to bridge remote connection", "remote", spec.Listen, "err", err)
+		common.RejectStream(ch, err)
+		return
+	}
+	slog.Debug("bridging remote connection", "remote", spec.Listen, "local", local, "label", ch.Label())
+	bridgeStream(ch, conn, []*peer{p}, spec, limits)
+}
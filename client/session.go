@@ -0,0 +1,215 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"wtt/common"
+	"wtt/common/rtc"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// session holds the peer connections to the host that streams are bridged
+// over. It connects when the first stream needs it. A lazy session connects
+// again for the next stream once its connections ended, and tears them down
+// when no stream used them for idleTimeout; the connections of an eager
+// session are expected to last as long as the client, unless it reconnects,
+// as a session failing over between hosts does.
+type session struct {
+	connect     func(ctx context.Context) ([]*peer, common.ChannelSpec, error)
+	lazy        bool
+	reconnect   bool
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	peers   []*peer
+	spec    common.ChannelSpec
+	streams int
+	idle    *time.Timer
+	// ended is closed once the connections of an eager session ended, err
+	// tells why.
+	ended chan struct{}
+	err   error
+}
+
+func newSession(connect func(ctx context.Context) ([]*peer, common.ChannelSpec, error), lazy, reconnect bool, idleTimeout time.Duration) *session {
+	return &session{
+		connect:     connect,
+		lazy:        lazy,
+		reconnect:   reconnect,
+		idleTimeout: idleTimeout,
+		ended:       make(chan struct{}),
+	}
+}
+
+// acquire returns the peers to bridge a new stream over and the spec of its
+// channels, connecting first if needed. Every acquire is to be followed by a
+// release once the stream is done.
+func (s *session) acquire(ctx context.Context) ([]*peer, common.ChannelSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.peers == nil {
+		select {
+		case <-s.ended:
+			return nil, s.spec, s.err
+		default:
+		}
+		if s.lazy {
+			slog.Info("connecting to host on demand")
+		}
+		peers, spec, err := s.connect(ctx)
+		if err != nil {
+			return nil, spec, err
+		}
+		s.peers, s.spec = peers, spec
+		go s.watch(peers)
+	}
+	s.streams++
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	return s.peers, s.spec, nil
+}
+
+// acquireRetrying is acquire for an eager session, connecting again with
+// backoff until it succeeds, the session ended or ctx is done, as the host
+// may not be registered yet or be briefly unreachable.
+func (s *session) acquireRetrying(ctx context.Context) ([]*peer, common.ChannelSpec, error) {
+	var peers []*peer
+	var spec common.ChannelSpec
+	err := retry(ctx, func() (err error) {
+		peers, spec, err = s.acquire(ctx)
+		return err
+	}, func(error) bool {
+		select {
+		case <-s.ended:
+			return true
+		default:
+			return false
+		}
+	})
+	return peers, spec, err
+}
+
+const (
+	// minRetryWait is how long retry waits after the first failure.
+	minRetryWait = 500 * time.Millisecond
+	// maxRetryWait bounds how long retry waits between attempts.
+	maxRetryWait = 30 * time.Second
+)
+
+// retry calls connect until it succeeds, waiting twice as long after every
+// failure, up to maxRetryWait, until ctx is done or connect failed for good:
+// when the host presented the wrong fingerprint or one that cannot be pinned,
+// or final, if not nil, says so.
+func retry(ctx context.Context, connect func() error, final func(error) bool) error {
+	wait := minRetryWait
+	for {
+		err := connect()
+		untrusted := errors.Is(err, rtc.ErrFingerprintMismatch) || errors.Is(err, rtc.ErrUnpinnableHost)
+		if err == nil || ctx.Err() != nil || untrusted || final != nil && final(err) {
+			return err
+		}
+		slog.Warn("failed to connect to host, retrying", "err", err, "wait", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait = min(2*wait, maxRetryWait)
+	}
+}
+
+// release is called when a stream is done with the peers it acquired.
+func (s *session) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.streams--
+	if s.streams > 0 || !s.lazy || s.idleTimeout <= 0 || s.peers == nil {
+		return
+	}
+	peers := s.peers
+	s.idle = time.AfterFunc(s.idleTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.streams > 0 || !s.current(peers) {
+			return
+		}
+		slog.Info("closing idle session", "idle", s.idleTimeout)
+		s.teardownLocked()
+	})
+}
+
+// watch waits for the control channel or the connection of one of peers to
+// close, which ends the session.
+func (s *session) watch(peers []*peer) {
+	ended := make(chan error, len(peers))
+	for _, p := range peers {
+		go func() {
+			done := make(chan error, 1)
+			go func() { done <- p.ch.Wait() }()
+			select {
+			case err := <-done:
+				if err != nil {
+					ended <- fmt.Errorf("control channel: %w", err)
+					return
+				}
+				ended <- errors.New("session closed by host")
+			case <-p.closed:
+				ended <- webrtc.ErrConnectionClosed
+			}
+		}()
+	}
+	err := <-ended
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.current(peers) {
+		// The session was torn down already.
+		return
+	}
+	s.teardownLocked()
+	if s.lazy || s.reconnect {
+		slog.Info("session ended, connecting again for the next connection", "err", err)
+		return
+	}
+	s.err = err
+	close(s.ended)
+}
+
+// drop tears down peers, the connections of the session, if they are still
+// current, so that the next acquire connects again.
+func (s *session) drop(peers []*peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current(peers) {
+		s.teardownLocked()
+	}
+}
+
+// close tears the session down for good.
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.teardownLocked()
+}
+
+func (s *session) current(peers []*peer) bool {
+	return len(s.peers) > 0 && s.peers[0] == peers[0]
+}
+
+func (s *session) teardownLocked() {
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	closePeers(s.peers)
+	s.peers = nil
+}
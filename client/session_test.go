@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"wtt/common"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// testPeer returns a peer whose peer connection is never connected.
+func testPeer(t *testing.T) *peer {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	dc, err := pc.CreateDataChannel(common.ControlLabel, nil)
+	require.NoError(t, err)
+
+	closed := make(chan struct{})
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed {
+			once.Do(func() { close(closed) })
+		}
+	})
+	return &peer{pc: pc, ch: common.NewChannel(dc), closed: closed}
+}
+
+func TestLazySession(t *testing.T) {
+	const idle = 50 * time.Millisecond
+	var connects atomic.Int32
+	s := newSession(func(ctx context.Context) ([]*peer, common.ChannelSpec, error) {
+		connects.Add(1)
+		return []*peer{testPeer(t)}, common.ChannelSpec{}, nil
+	}, true, false, idle)
+	defer s.close()
+
+	// Nothing is dialed before the first stream.
+	time.Sleep(2 * idle)
+	require.Zero(t, connects.Load())
+
+	// Concurrent streams share the connection.
+	first, _, err := s.acquire(context.Background())
+	require.NoError(t, err)
+	second, _, err := s.acquire(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, first, second)
+	require.Equal(t, int32(1), connects.Load())
+
+	// A stream coming soon enough after the others ended keeps the
+	// connection up.
+	s.release()
+	s.release()
+	third, _, err := s.acquire(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, first, third)
+	time.Sleep(2 * idle)
+	require.Equal(t, webrtc.PeerConnectionStateNew, first[0].pc.ConnectionState())
+
+	// Once idle for long enough it is torn down, and the next stream dials
+	// again.
+	s.release()
+	require.Eventually(t, func() bool {
+		return first[0].pc.ConnectionState() == webrtc.PeerConnectionStateClosed
+	}, time.Second, 10*time.Millisecond)
+	fourth, _, err := s.acquire(context.Background())
+	require.NoError(t, err)
+	require.NotEqual(t, first, fourth)
+	require.Equal(t, int32(2), connects.Load())
+	s.release()
+}
@@ -0,0 +1,435 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"wtt/common"
+	"wtt/common/rtc/offerer"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// SOCKS5 as of RFC 1928, without authentication.
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+
+	socksConnect   = 0x01
+	socksAssociate = 0x03
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded          = 0x00
+	socksGeneralFailure     = 0x01
+	socksNotAllowed         = 0x02
+	socksNetworkUnreachable = 0x03
+	socksHostUnreachable    = 0x04
+	socksConnectionRefused  = 0x05
+	socksCommandUnsupported = 0x07
+	socksAddressUnsupported = 0x08
+)
+
+const (
+	// socksHandshakeTimeout bounds the SOCKS negotiation of a connection.
+	socksHandshakeTimeout = 30 * time.Second
+	// socksQueueSize is how many datagrams to a new UDP destination are
+	// queued while its data channel opens.
+	socksQueueSize = 64
+)
+
+var errSOCKSAddressType = errors.New("unsupported SOCKS address type")
+
+// serveSOCKS serves the SOCKS5 connection conn. A CONNECT request is bridged
+// over a new stream whose host side dials the destination, a UDP ASSOCIATE
+// request relays datagrams over a data channel per destination until conn
+// is closed.
+func serveSOCKS(ctx context.Context, peers []*peer, conn net.Conn, spec common.ChannelSpec, limits common.Shaper, opts Options) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	r := bufio.NewReader(conn)
+
+	cmd, target, err := socksHandshake(r, conn)
+	if err != nil {
+		slog.Warn("SOCKS handshake failed", "from", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+
+	switch cmd {
+	case socksConnect:
+		slog.Debug("SOCKS connect", "from", conn.RemoteAddr(), "target", target)
+		ch, err := openTarget(ctx, peers, spec, target, opts)
+		if err != nil {
+			slog.Warn("SOCKS connect failed", "target", target, "err", err)
+			writeSOCKSReply(conn, socksReplyCode(err), nil)
+			conn.Close()
+			return
+		}
+		if err := writeSOCKSReply(conn, socksSucceeded, nil); err != nil {
+			ch.Close()
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		bridgeStream(ch, &readerConn{conn, r}, peers, spec, limits)
+
+	case socksAssociate:
+		slog.Debug("SOCKS UDP associate", "from", conn.RemoteAddr())
+		ip := conn.LocalAddr().(*net.TCPAddr).IP
+		pconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			slog.Warn("SOCKS UDP associate failed", "err", err)
+			writeSOCKSReply(conn, socksGeneralFailure, nil)
+			conn.Close()
+			return
+		}
+		if err := writeSOCKSReply(conn, socksSucceeded, pconn.LocalAddr().(*net.UDPAddr)); err != nil {
+			pconn.Close()
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+
+		a := &socksAssociation{ctx: ctx, peer: peers[0], pconn: pconn, limits: limits, opts: opts, dests: map[string]*socksDest{}}
+		go a.relay()
+		// The association lasts as long as the connection it was requested on.
+		io.Copy(io.Discard, r)
+		conn.Close()
+		a.close()
+
+	default:
+		writeSOCKSReply(conn, socksCommandUnsupported, nil)
+		conn.Close()
+	}
+}
+
+// socksHandshake negotiates the authentication method and reads the request,
+// returning its command and destination.
+func socksHandshake(r *bufio.Reader, w io.Writer) (byte, string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, "", err
+	}
+	if hdr[0] != socksVersion {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return 0, "", err
+	}
+	if !strings.ContainsRune(string(methods), socksNoAuth) {
+		w.Write([]byte{socksVersion, socksNoAcceptable})
+		return 0, "", errors.New("client offers no supported authentication method")
+	}
+	if _, err := w.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return 0, "", err
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return 0, "", err
+	}
+	if req[0] != socksVersion {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+	target, err := readSOCKSAddr(r)
+	if errors.Is(err, errSOCKSAddressType) {
+		writeSOCKSReply(w, socksAddressUnsupported, nil)
+	}
+	return req[1], target, err
+}
+
+// readSOCKSAddr reads an address, as in requests and UDP headers, as
+// host:port.
+func readSOCKSAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksIPv4, socksIPv6:
+		b := make([]byte, 4)
+		if atyp[0] == socksIPv6 {
+			b = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		ip, _ := netip.AddrFromSlice(b)
+		host = ip.String()
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", fmt.Errorf("%w %d", errSOCKSAddressType, atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendSOCKSAddr appends the host:port address addr in SOCKS form.
+func appendSOCKSAddr(b []byte, addr string) []byte {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.ParseUint(port, 10, 16)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() || ip.Is4In6() {
+			b = append(b, socksIPv4)
+			b = append(b, ip.Unmap().AsSlice()...)
+		} else {
+			b = append(b, socksIPv6)
+			b = append(b, ip.AsSlice()...)
+		}
+	} else {
+		b = append(b, socksDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(p))
+}
+
+// writeSOCKSReply replies to a request with rep and the bound address bnd,
+// the unspecified address when nil.
+func writeSOCKSReply(w io.Writer, rep byte, bnd *net.UDPAddr) error {
+	addr := "0.0.0.0:0"
+	if bnd != nil {
+		addr = bnd.AddrPort().String()
+	}
+	_, err := w.Write(appendSOCKSAddr([]byte{socksVersion, rep, 0}, addr))
+	return err
+}
+
+// socksReplyCode returns the reply code for the failure to connect err.
+func socksReplyCode(err error) byte {
+	var reset *common.ResetError
+	if !errors.As(err, &reset) {
+		return socksGeneralFailure
+	}
+	// The host resets the stream with the error of its dial.
+	switch reset.Code {
+	case common.ResetNotAllowed:
+		return socksNotAllowed
+	case common.ResetRefused:
+		return socksConnectionRefused
+	case common.ResetNetworkUnreachable:
+		return socksNetworkUnreachable
+	case common.ResetHostUnreachable, common.ResetTimeout:
+		return socksHostUnreachable
+	default:
+		return socksGeneralFailure
+	}
+}
+
+// socksAssociation relays the datagrams of a UDP association, over a data
+// channel per destination.
+type socksAssociation struct {
+	ctx    context.Context
+	peer   *peer
+	pconn  *net.UDPConn
+	limits common.Shaper
+	opts   Options
+
+	mu sync.Mutex
+	// client is the address of the SOCKS client, taken from its first
+	// datagram. Datagrams from other addresses are dropped.
+	client netip.AddrPort
+	dests  map[string]*socksDest
+	closed bool
+}
+
+func (a *socksAssociation) relay() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := a.pconn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			a.close()
+			return
+		}
+
+		a.mu.Lock()
+		if !a.client.IsValid() {
+			a.client = from
+		}
+		client := a.client
+		a.mu.Unlock()
+		if from != client {
+			slog.Debug("dropping SOCKS datagram from foreign address", "from", from)
+			continue
+		}
+
+		// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+		if n < 4 || buf[2] != 0 {
+			slog.Debug("dropping fragmented or short SOCKS datagram", "size", n)
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		target, err := readSOCKSAddr(r)
+		if err != nil {
+			slog.Debug("dropping SOCKS datagram", "err", err)
+			continue
+		}
+		d := a.dest(target)
+		if d == nil {
+			return
+		}
+		d.queue(append([]byte(nil), buf[n-r.Len():n]...))
+	}
+}
+
+// dest returns the destination target, opening its data channel when it is
+// new, or nil once the association is closed.
+func (a *socksAssociation) dest(target string) *socksDest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	if d := a.dests[target]; d != nil {
+		return d
+	}
+	d := &socksDest{
+		assoc:  a,
+		header: appendSOCKSAddr([]byte{0, 0, 0}, target),
+		in:     make(chan []byte, socksQueueSize),
+		done:   make(chan struct{}),
+	}
+	a.dests[target] = d
+	go a.bridge(d, target)
+	return d
+}
+
+// bridge opens the data channel to target and bridges d over it.
+func (a *socksAssociation) bridge(d *socksDest, target string) {
+	defer func() {
+		a.mu.Lock()
+		delete(a.dests, target)
+		a.mu.Unlock()
+		d.Close()
+	}()
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		slog.Error("failed to create data channel label", "err", err)
+		return
+	}
+	// Run has validated the reliability already.
+	init, _ := a.opts.Reliability.Init()
+	if init == nil {
+		init = &webrtc.DataChannelInit{}
+	}
+	protocol := common.ChannelSpec{Target: target, Network: common.UDP}.Encode()
+	init.Protocol = &protocol
+	dc, err := offerer.B_CreateDataChannel(a.peer.pc, id.String(), init)
+	if err != nil {
+		slog.Error("failed to create data channel", "err", err)
+		return
+	}
+	ch := common.NewChannel(dc)
+	select {
+	case <-ch.Opened():
+	case <-d.done:
+		ch.Close()
+		return
+	case <-a.ctx.Done():
+		ch.Close()
+		return
+	}
+
+	slog.Debug("SOCKS UDP destination", "target", target, "label", ch.Label())
+	if err := <-common.BridgePacket(ch, d, a.opts.Flows, &a.limits); err != nil {
+		slog.Debug("SOCKS UDP bridge finished", "target", target, "err", err)
+	}
+}
+
+func (a *socksAssociation) close() {
+	a.mu.Lock()
+	a.closed = true
+	dests := a.dests
+	a.dests = map[string]*socksDest{}
+	a.mu.Unlock()
+
+	a.pconn.Close()
+	for _, d := range dests {
+		d.Close()
+	}
+}
+
+// socksDest is the packet connection BridgePacket relays the datagrams of an
+// association to one destination through. Datagrams read from it are those
+// the SOCKS client sent to the destination, datagrams written to it go back
+// to the client with the SOCKS header of the destination.
+type socksDest struct {
+	assoc  *socksAssociation
+	header []byte
+	in     chan []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (d *socksDest) queue(p []byte) {
+	select {
+	case d.in <- p:
+	default:
+		slog.Debug("SOCKS destination queue full, dropping datagram", "size", len(p))
+	}
+}
+
+func (d *socksDest) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case b := <-d.in:
+		d.assoc.mu.Lock()
+		client := d.assoc.client
+		d.assoc.mu.Unlock()
+		return copy(p, b), net.UDPAddrFromAddrPort(client), nil
+	case <-d.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (d *socksDest) WriteTo(p []byte, addr net.Addr) (int, error) {
+	b := append(d.header[:len(d.header):len(d.header)], p...)
+	if _, err := d.assoc.pconn.WriteTo(b, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (d *socksDest) Close() error {
+	d.closeOnce.Do(func() { close(d.done) })
+	return nil
+}
+
+func (d *socksDest) LocalAddr() net.Addr {
+	return d.assoc.pconn.LocalAddr()
+}
+
+func (d *socksDest) SetDeadline(time.Time) error      { return os.ErrNoDeadline }
+func (d *socksDest) SetReadDeadline(time.Time) error  { return os.ErrNoDeadline }
+func (d *socksDest) SetWriteDeadline(time.Time) error { return os.ErrNoDeadline }
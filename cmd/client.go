@@ -2,31 +2,107 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"os"
+	"time"
 	"wtt/client"
 	"wtt/common"
 )
 
 type ClientCmd struct {
-	HostID           string `name:"host-id" short:"i" required:"" help:"Target host ID to connect to."`
-	SignalingAddress string `name:"signaling-address" short:"s" required:"" help:"Signaling server HTTP address (http/https), e.g. http://127.0.0.1:8080."`
-	LocalAddress     string `name:"local-address" short:"l" required:"" help:"Local address to bridge (eg. 127.0.0.1:22)."`
-	Protocol         string `name:"protocol" short:"p" default:"tcp" help:"Transport protocol: tcp or udp."`
+	HostID           string        `name:"host-id" short:"i" help:"Target host ID to connect to, or a comma-separated list of host IDs to fail over between (e.g. db-a,db-b); required unless all forwards are given with --forward."`
+	HostOrder        string        `name:"host-order" default:"ordered" enum:"ordered,random" help:"Order in which a list of host IDs is tried: ordered or random."`
+	SignalingAddress string        `name:"signaling-address" short:"s" required:"" help:"Signaling server HTTP address (http/https), e.g. http://127.0.0.1:8080."`
+	LocalAddress     string        `name:"local-address" short:"l" required:"" xor:"listen" help:"Local address to bridge (eg. 127.0.0.1:22)."`
+	Forwards         []string      `name:"forward" short:"L" required:"" xor:"listen" sep:"none" help:"Forward a local address to a service of a host, as local=host[/service] (e.g. 127.0.0.1:5432=db-host/postgres), where host may be a list of host IDs like --host-id, may be repeated; forwards to the same host share a connection."`
+	SOCKS            string        `name:"socks" required:"" xor:"listen" help:"Run a SOCKS5 server on this address (e.g. 127.0.0.1:1080) whose destinations the host dials, subject to its allow-list."`
+	HTTPProxy        string        `name:"http-proxy" required:"" xor:"listen" help:"Run an HTTP proxy on this address (e.g. 127.0.0.1:3128) for CONNECT and absolute-URI requests, whose destinations the host dials, subject to its allow-list."`
+	RemoteListens    []string      `name:"remote-listen" short:"R" required:"" xor:"listen" sep:"none" help:"Have the host listen on an address and bridge its connections to a local one, as remote=local (e.g. 127.0.0.1:8080=127.0.0.1:3000), may be repeated; the host must allow the address with --allow-listen."`
+	Stdio            bool          `name:"stdio" required:"" xor:"listen" help:"Bridge a single stream to stdin/stdout instead of listening, e.g. as an SSH ProxyCommand."`
+	ProxyAuth        string        `name:"http-proxy-auth" help:"Require HTTP proxy clients to authenticate with these basic credentials (user:password)."`
+	Target           string        `name:"target" help:"Destination the host dials for every connection instead of its local service (e.g. 10.0.3.7:5432, db.internal:5432); the host must allow it with --allow."`
+	Lazy             bool          `name:"lazy" help:"Connect to the host only when the first local connection arrives, and again after the session ended."`
+	IdleTimeout      time.Duration `name:"idle-timeout" default:"5m" help:"With --lazy, close the session after this long without connections (0 for never)."`
+	Protocol         string        `name:"protocol" short:"p" default:"tcp" help:"Transport protocol: tcp, udp, unix or unixgram (the local address is then a socket path)."`
+	ICETCP           bool          `name:"ice-tcp" help:"Also gather active ICE-TCP candidates, for networks that drop outbound UDP."`
+	Certificate      string        `name:"certificate" type:"path" help:"DTLS certificate file, created if missing (default: a new certificate per connection)."`
+	KnownHosts       string        `name:"known-hosts" type:"path" help:"File pinning host fingerprints; unknown hosts are trusted on first use. The host needs --certificate for its fingerprint to persist."`
+	ReplaceKnownHost bool          `name:"replace-known-host" help:"Accept a host fingerprint that differs from known-hosts and record it."`
+	Compression      string        `name:"compression" default:"none" enum:"none,deflate" help:"Compress TCP streams with this codec if the host accepts it: none or deflate."`
+	Stripes          int           `name:"stripes" default:"1" help:"Stripe every TCP stream over this many peer connections to the host, for more throughput on high-latency links."`
+	Priority         string        `name:"priority" default:"auto" enum:"auto,interactive,bulk" help:"Scheduling class of TCP streams: interactive, bulk, or auto (interactive until a stream moved 1MiB)."`
+	ICEFlags         `embed:""`
+	TimeoutFlags     `embed:""`
+	HTTPFlags        `embed:""`
+	UDPFlags         `embed:""`
+	ReliabilityFlags `embed:""`
+	RateFlags        `embed:""`
+	UnixFlags        `embed:""`
 }
 
 func (c *ClientCmd) Run() error {
 	var logLevel slog.Level
+	if c.Stdio {
+		// Keep the stderr of a ProxyCommand quiet unless something is wrong.
+		logLevel = slog.LevelWarn
+	}
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 		Level: logLevel,
 	})))
 
-	if c.Protocol != "tcp" && c.Protocol != "udp" {
+	if !validProtocol(c.Protocol) {
 		slog.Error("unsupported protocol", "protocol", c.Protocol)
 		return nil
 	}
 
-	ec := client.Run(context.Background(), c.SignalingAddress, c.HostID, c.LocalAddress, common.NetProtocol(c.Protocol))
+	var forwards []client.Forward
+	for _, spec := range c.Forwards {
+		f, err := client.ParseForward(spec)
+		if err != nil {
+			return err
+		}
+		forwards = append(forwards, f)
+	}
+	var remoteListens []client.RemoteListen
+	for _, spec := range c.RemoteListens {
+		l, err := client.ParseRemoteListen(spec)
+		if err != nil {
+			return err
+		}
+		remoteListens = append(remoteListens, l)
+	}
+	if c.HostID == "" && len(forwards) == 0 {
+		return errors.New("missing flag: --host-id")
+	}
+
+	ec := client.Run(context.Background(), c.SignalingAddress, c.HostID, c.LocalAddress, common.NetProtocol(c.Protocol), client.Options{
+		ICETCP:           c.ICETCP,
+		ICE:              c.ICEFlags.options(),
+		Timeouts:         c.TimeoutFlags.timeouts(),
+		HTTP:             c.HTTPFlags.options(),
+		Certificate:      c.Certificate,
+		KnownHosts:       c.KnownHosts,
+		ReplaceKnownHost: c.ReplaceKnownHost,
+		Flows:            c.UDPFlags.options(),
+		Compression:      common.Codec(c.Compression),
+		Stripes:          c.Stripes,
+		Upload:           c.UploadLimit,
+		Download:         c.DownloadLimit,
+		Priority:         common.Priority(c.Priority),
+		SOCKS:            c.SOCKS,
+		HTTPProxy:        c.HTTPProxy,
+		ProxyAuth:        c.ProxyAuth,
+		Stdio:            c.Stdio,
+		SocketMode:       os.FileMode(c.SocketMode),
+		Forwards:         forwards,
+		HostOrder:        client.HostOrder(c.HostOrder),
+		Lazy:             c.Lazy,
+		IdleTimeout:      c.IdleTimeout,
+		RemoteListens:    remoteListens,
+		Target:           c.Target,
+		Reliability:      c.ReliabilityFlags.reliability(),
+	})
 	slog.Info("client started")
 
 	return <-ec
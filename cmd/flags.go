@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+	"wtt/common"
+	"wtt/common/rtc"
+)
+
+// ICEFlags are the ICE related flags shared by the client and host commands.
+type ICEFlags struct {
+	ICEServers    []string      `name:"ice-server" help:"STUN or TURN server URL, may be repeated (e.g. turn:turn.example.com:3478)."`
+	ICEUsername   string        `name:"ice-username" help:"Username for TURN servers."`
+	ICECredential string        `name:"ice-credential" help:"Credential for TURN servers."`
+	Privacy       string        `name:"privacy" default:"off" help:"Candidate privacy: off, relay-only (TURN only) or no-host (hide local addresses)."`
+	RestartGrace  time.Duration `name:"ice-restart-grace" default:"30s" help:"How long a lost connection may take to recover through an ICE restart (0 disables restarts)."`
+}
+
+func (f ICEFlags) options() rtc.ICEOptions {
+	return rtc.ICEOptions{
+		Servers:      f.ICEServers,
+		Username:     f.ICEUsername,
+		Credential:   f.ICECredential,
+		Privacy:      common.PrivacyMode(f.Privacy),
+		RestartGrace: f.RestartGrace,
+	}
+}
+
+// TimeoutFlags bound the phases of establishing a connection.
+type TimeoutFlags struct {
+	GatherTimeout time.Duration `name:"gather-timeout" default:"15s" help:"Deadline for ICE candidate gathering (0 for none)."`
+	SignalTimeout time.Duration `name:"signal-timeout" default:"30s" help:"Deadline for an offer/answer exchange through the signaling server (0 for none)."`
+	ICETimeout    time.Duration `name:"ice-timeout" default:"30s" help:"Deadline for the ICE connection to be established (0 for none)."`
+	OpenTimeout   time.Duration `name:"open-timeout" default:"15s" help:"Deadline for a data channel to open (0 for none)."`
+}
+
+func (f TimeoutFlags) timeouts() rtc.Timeouts {
+	return rtc.Timeouts{
+		Gather: f.GatherTimeout,
+		Signal: f.SignalTimeout,
+		ICE:    f.ICETimeout,
+		Open:   f.OpenTimeout,
+	}
+}
+
+// HTTPFlags configure the HTTP client used to reach the signaling server.
+type HTTPFlags struct {
+	Proxy         string            `name:"proxy" help:"HTTP proxy URL for the signaling server (default: from HTTP_PROXY/HTTPS_PROXY)."`
+	CACerts       []string          `name:"ca-cert" type:"path" help:"PEM file with extra CA certificates to trust for the signaling server, may be repeated."`
+	Headers       map[string]string `name:"header" help:"Extra header sent to the signaling server (NAME=VALUE), may be repeated."`
+	HTTPTimeout   time.Duration     `name:"http-timeout" default:"0" help:"Timeout for every signaling request, longer than the 25s the server holds a poll (0 for none)."`
+	HTTPRetries   int               `name:"http-retries" default:"0" help:"How many times a failed signaling poll is retried (offers and answers are not)."`
+	HTTPRetryWait time.Duration     `name:"http-retry-wait" default:"1s" help:"Wait before the first retry of a signaling request, backing off on further retries."`
+}
+
+func (f HTTPFlags) options() rtc.HTTPOptions {
+	return rtc.HTTPOptions{
+		Proxy:     f.Proxy,
+		CACerts:   f.CACerts,
+		Headers:   f.Headers,
+		Timeout:   f.HTTPTimeout,
+		Retries:   f.HTTPRetries,
+		RetryWait: f.HTTPRetryWait,
+	}
+}
+
+// UDPFlags limit the UDP flows tracked by a tunnel.
+type UDPFlags struct {
+	UDPIdleTimeout time.Duration `name:"udp-idle-timeout" default:"2m" help:"How long a UDP flow is kept without datagrams."`
+	UDPMaxFlows    int           `name:"udp-max-flows" default:"1024" help:"Maximum number of concurrent UDP flows; datagrams from new sources are dropped beyond it."`
+}
+
+func (f UDPFlags) options() common.FlowOptions {
+	return common.FlowOptions{
+		IdleTimeout: f.UDPIdleTimeout,
+		MaxFlows:    f.UDPMaxFlows,
+	}
+}
+
+// ReliabilityFlags choose how the data channel of a UDP tunnel delivers
+// datagrams.
+type ReliabilityFlags struct {
+	UDPReliable   bool          `name:"udp-reliable" help:"Deliver UDP datagrams reliably and in order, like TCP, instead of at most once."`
+	UDPPacketLife time.Duration `name:"udp-max-packet-lifetime" help:"Retransmit lost UDP datagrams for up to this long (at most 65s; default: never retransmit)."`
+}
+
+func (f ReliabilityFlags) reliability() rtc.Reliability {
+	return rtc.Reliability{
+		Reliable:          f.UDPReliable,
+		MaxPacketLifeTime: f.UDPPacketLife,
+	}
+}
+
+// RateFlags limit the bandwidth of a tunnel.
+type RateFlags struct {
+	UploadLimit   common.Rate `name:"upload-limit" default:"0" help:"Limit the rate of data sent through the tunnel, in bytes per second with an optional K, M, G, Ki, Mi or Gi suffix (0 for none)."`
+	DownloadLimit common.Rate `name:"download-limit" default:"0" help:"Limit the rate of data received through the tunnel, like --upload-limit (0 for none)."`
+}
+
+// UnixFlags configure the unix domain sockets of a tunnel.
+type UnixFlags struct {
+	SocketMode fileMode `name:"socket-mode" default:"0600" help:"Permission of the unix sockets created, in octal."`
+}
+
+// fileMode is a file permission given in octal.
+type fileMode os.FileMode
+
+func (m *fileMode) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 8, 32)
+	if err != nil || v > 0o777 {
+		return fmt.Errorf("invalid file mode %q", text)
+	}
+	*m = fileMode(v)
+	return nil
+}
+
+// validProtocol reports whether name is a protocol tunnels can bridge.
+func validProtocol(name string) bool {
+	switch common.NetProtocol(name) {
+	case common.TCP, common.UDP, common.Unix, common.Unixgram:
+		return true
+	}
+	return false
+}
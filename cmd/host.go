@@ -3,26 +3,64 @@ package cmd
 import (
 	"context"
 	"log/slog"
+	"os"
 	"wtt/common"
 	"wtt/host"
 )
 
 type HostCmd struct {
-	ID               string `name:"id" short:"i" required:"" help:"Host ID."`
-	SignalingAddress string `name:"signaling-address" short:"s" required:"" help:"Signaling server HTTP address (http/https), e.g. http://127.0.0.1:8080."`
-	LocalAddress     string `name:"local-address" short:"l" required:"" help:"Local address to bridge (e.g. 127.0.0.1:22)."`
-	Protocol         string `name:"protocol" short:"p" default:"tcp" help:"Transport protocol: tcp or udp."`
+	ID               string            `name:"id" short:"i" required:"" help:"Host ID."`
+	SignalingAddress string            `name:"signaling-address" short:"s" required:"" help:"Signaling server HTTP address (http/https), e.g. http://127.0.0.1:8080."`
+	LocalAddress     string            `name:"local-address" short:"l" help:"Local address to bridge (e.g. 127.0.0.1:22); may be omitted when clients only use SOCKS or --target."`
+	Protocol         string            `name:"protocol" short:"p" default:"tcp" help:"Transport protocol: tcp, udp, unix or unixgram (the local address is then a socket path)."`
+	ICETCPAddress    string            `name:"ice-tcp-address" help:"Accept passive ICE-TCP connections on this address (e.g. :3478)."`
+	Certificate      string            `name:"certificate" type:"path" help:"DTLS certificate file, created if missing; clients pin its fingerprint (default: a new certificate per connection)."`
+	AcceptCodecs     []string          `name:"accept-codec" default:"deflate" enum:"none,deflate" help:"Compression codec clients may use for TCP streams, may be repeated (none to refuse compression)."`
+	Services         map[string]string `name:"service" help:"Service clients may forward to by name, as name=address, with an optional tcp:, udp:, unix: or unixgram: prefix (e.g. docker=unix:/var/run/docker.sock), may be repeated."`
+	Allow            []string          `name:"allow" help:"Destination clients may reach with --target or SOCKS, as IP, CIDR or host name (*.domain for its subdomains) with an optional port or port range (e.g. 10.0.0.0/8, 192.168.1.10:22, db.internal:5432, *.corp.example:8000-8099, [fd00::/8]:443), may be repeated (default: none)."`
+	AllowListen      []string          `name:"allow-listen" help:"Address clients may ask the host to listen on with --remote-listen, bridging its connections back to them, may be repeated (default: none)."`
+	ICEFlags         `embed:""`
+	TimeoutFlags     `embed:""`
+	HTTPFlags        `embed:""`
+	UDPFlags         `embed:""`
+	RateFlags        `embed:""`
+	UnixFlags        `embed:""`
 }
 
 func (h *HostCmd) Run() error {
 
-	if h.Protocol != "tcp" && h.Protocol != "udp" {
+	if !validProtocol(h.Protocol) {
 		slog.Error("unsupported protocol", "protocol", h.Protocol)
 		return nil
 	}
 
-	ec := host.Run(context.Background(), h.ID, h.SignalingAddress, h.LocalAddress, common.NetProtocol(h.Protocol))
+	ec := host.Run(context.Background(), h.ID, h.SignalingAddress, h.LocalAddress, common.NetProtocol(h.Protocol), host.Options{
+		ICETCPAddress: h.ICETCPAddress,
+		ICE:           h.ICEFlags.options(),
+		Timeouts:      h.TimeoutFlags.timeouts(),
+		HTTP:          h.HTTPFlags.options(),
+		Certificate:   h.Certificate,
+		Flows:         h.UDPFlags.options(),
+		Codecs:        codecs(h.AcceptCodecs),
+		Upload:        h.UploadLimit,
+		Download:      h.DownloadLimit,
+		Allow:         h.Allow,
+		Services:      h.Services,
+		SocketMode:    os.FileMode(h.SocketMode),
+		AllowListen:   h.AllowListen,
+	})
 	slog.Info("host started")
 
 	return <-ec
 }
+
+// codecs converts codec names, dropping none.
+func codecs(names []string) []common.Codec {
+	var cs []common.Codec
+	for _, name := range names {
+		if c := common.Codec(name); c != common.CodecNone {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
@@ -1,86 +1,347 @@
 package common
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// bufferedAmountHigh is how much data may be queued on a DataChannel
+	// before local reads are paused (streams) or datagrams dropped (packets).
+	bufferedAmountHigh = 1 << 20
+	// bufferedAmountLow is how far the queue has to drain before paused local
+	// reads resume.
+	bufferedAmountLow = 256 << 10
 
-	"github.com/pion/webrtc/v4"
+	// messageSize is the largest chunk read from a local connection and sent
+	// as one message.
+	messageSize = 16 * 1024
+	// bufferSize is the size of pooled buffers. Messages are read whole, so
+	// it leaves room for messages larger than messageSize.
+	bufferSize = 64 * 1024
 )
 
-// BridgeStream wires a WebRTC DataChannel with a stream-oriented net.Conn (like TCP) bidirectionally.
-func BridgeStream(dc *webrtc.DataChannel, local net.Conn) <-chan error {
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, bufferSize)
+		return &buf
+	},
+}
+
+// streamWindow is how many bytes of data a stream lets the remote side send
+// per channel before it has to wait for a window update.
+const streamWindow = 1 << 20
+
+// flushTimeout bounds how long a finished stream waits for its last data to
+// be delivered before closing the channel.
+const flushTimeout = 5 * time.Second
+
+// BridgeStream wires a MessageChannel with a stream-oriented net.Conn (like
+// TCP) bidirectionally.
+//
+// Both sides exchange data and control frames: EOF on a local connection is
+// passed on as a FIN, which half-closes the remote local connection, errors
+// are passed on as a RST with the reason, and each side grants the other a
+// window of data it may send so that a slow local connection does not pile
+// data up in the channel. The stream is done once both sides sent a FIN.
+//
+// shaper, if not nil, limits the rate of the stream and schedules it with the
+// other streams of its peer connection.
+func BridgeStream(ch MessageChannel, local net.Conn, shaper *Shaper) <-chan error {
 	ec := make(chan error, 1)
-	slog.Info("Bridging DataChannel with local TCP connection", "label", dc.Label(), "localAddr", local.LocalAddr(), "remoteAddr", local.RemoteAddr())
+	slog.Info("Bridging DataChannel with local TCP connection", "label", ch.Label(), "localAddr", local.LocalAddr(), "remoteAddr", local.RemoteAddr())
+
+	s := &stream{done: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mu)
+
+	spec, err := ch.Spec()
+	if err == nil && spec.Codec != CodecNone && spec.Codec != CodecDeflate {
+		err = fmt.Errorf("unsupported codec %q", spec.Codec)
+	}
+	var comp *compressor
+	if spec.Codec == CodecDeflate {
+		comp = &compressor{}
+	}
 
 	var closeOnce sync.Once
 	closeAndSignal := func(err error) {
 		closeOnce.Do(func() {
+			s.shutdown()
+			if err != nil {
+				var rst *ResetError
+				if !errors.As(err, &rst) {
+					sendReset(ch, err)
+				}
+				// Pass the failure on to the local peer as a TCP reset.
+				if tc, ok := local.(interface{ SetLinger(int) error }); ok {
+					tc.SetLinger(0)
+				}
+			}
+			// Deliver the last data and FIN or RST before tearing down.
+			ch.Flush(flushTimeout)
 			local.Close()
-			dc.Close()
-			if err != nil && err != io.EOF {
+			ch.Close()
+			if err != nil {
 				ec <- err
 			}
 			close(ec)
 		})
 	}
+	if err != nil {
+		closeAndSignal(err)
+		return ec
+	}
 
 	// Remote -> Local
-	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		if _, err := local.Write(msg.Data); err != nil {
-			slog.Error("failed to write to local connection", "err", err)
-			closeAndSignal(fmt.Errorf("write to local: %w", err))
+	go func() {
+		buf := bufferPool.Get().(*[]byte)
+		defer bufferPool.Put(buf)
+		var dbuf *[]byte
+		if comp != nil {
+			dbuf = bufferPool.Get().(*[]byte)
+			defer bufferPool.Put(dbuf)
+		}
+
+		// Let the remote side start sending.
+		window := ch.window()
+		if err := sendWindow(ch, window); err != nil {
+			// The remote side may already have reset the stream, which the
+			// reads below report.
+			slog.Debug("failed to send window", "label", ch.Label(), "err", err)
 		}
-	})
 
-	dc.OnClose(func() {
-		slog.Debug("data channel closed")
-		closeAndSignal(nil) // Clean close
-	})
+		consumed := 0
+		for {
+			n, err := ch.Read(*buf)
+			if err != nil {
+				if err == io.EOF && s.finished() {
+					closeAndSignal(nil)
+				} else if err == io.EOF {
+					closeAndSignal(errors.New("data channel closed before the stream finished"))
+				} else {
+					closeAndSignal(fmt.Errorf("read from dc: %w", err))
+				}
+				return
+			}
+
+			typ, payload, err := parseFrame((*buf)[:n])
+			if err != nil {
+				closeAndSignal(err)
+				return
+			}
+			if typ == frameDeflate && comp != nil {
+				n, err := decompress(*dbuf, payload)
+				if err != nil {
+					closeAndSignal(err)
+					return
+				}
+				typ, payload = frameData, (*dbuf)[:n]
+			}
+			switch typ {
+			case frameData:
+				// Limit what went over the wire, before decompression.
+				if !shaper.download().Wait(n, s.done) {
+					return
+				}
+				if _, err := local.Write(payload); err != nil {
+					closeAndSignal(fmt.Errorf("write to local: %w", err))
+					return
+				}
+				consumed += len(payload)
+				if consumed >= window/4 {
+					if err := sendWindow(ch, consumed); err != nil {
+						closeAndSignal(fmt.Errorf("send window: %w", err))
+						return
+					}
+					consumed = 0
+				}
+			case frameFIN:
+				slog.Debug("remote stream closed for writing", "label", ch.Label())
+				if cw, ok := local.(interface{ CloseWrite() error }); ok {
+					if err := cw.CloseWrite(); err != nil {
+						slog.Debug("failed to half-close local connection", "err", err)
+					}
+				}
+				if s.finish(false) {
+					// Keep reading while the last data is flushed, so that a
+					// detached channel learns when the remote side closes it.
+					go closeAndSignal(nil)
+				}
+			case frameRST:
+				closeAndSignal(parseReset(payload))
+				return
+			case frameWindow:
+				if len(payload) != 4 {
+					closeAndSignal(fmt.Errorf("malformed %s frame", typ))
+					return
+				}
+				s.grant(int(binary.BigEndian.Uint32(payload)))
+			default:
+				closeAndSignal(fmt.Errorf("unexpected %s frame", typ))
+				return
+			}
+		}
+	}()
 
 	// Local -> Remote
 	go func() {
-		buf := make([]byte, 16*1024)
+		buf := bufferPool.Get().(*[]byte)
+		defer bufferPool.Put(buf)
+		if comp != nil {
+			defer func() {
+				slog.Debug("stream compression", "label", ch.Label(), "stats", comp.stats)
+			}()
+		}
+
+		sent := 0
 		for {
-			n, err := local.Read(buf)
+			limit, ok := s.acquire(messageSize)
+			if !ok {
+				return
+			}
+
+			// Leave room for the frame type in front of the data.
+			n, err := local.Read((*buf)[1 : 1+limit])
+			s.release(limit - n)
 			if n > 0 {
-				if sendErr := dc.Send(buf[:n]); sendErr != nil {
-					slog.Error("failed to send to data channel", "err", sendErr)
-					closeAndSignal(fmt.Errorf("send to dc: %w", sendErr))
+				(*buf)[0] = byte(frameData)
+				msg := (*buf)[:1+n]
+				if comp != nil {
+					msg = comp.frame(msg)
+				}
+				if !shaper.upload().Wait(len(msg), s.done) {
 					return
 				}
+				if _, err := ch.Write(msg); err != nil {
+					closeAndSignal(fmt.Errorf("send to dc: %w", err))
+					return
+				}
+				sent += n
+				shaper.schedule(ch, sent, s.done)
 			}
-			if err != nil {
-				if err == io.EOF {
-					slog.Debug("local connection closed (EOF)")
+			if err == io.EOF {
+				slog.Debug("local connection closed for writing (EOF)")
+				if err := sendControl(ch, frameFIN, nil); err != nil {
+					closeAndSignal(fmt.Errorf("send to dc: %w", err))
+					return
+				}
+				if s.finish(true) {
 					closeAndSignal(nil)
-				} else {
-					slog.Error("failed to read from local connection", "err", err)
-					closeAndSignal(err)
 				}
 				return
 			}
+			if err != nil {
+				closeAndSignal(fmt.Errorf("read from local: %w", err))
+				return
+			}
 		}
 	}()
 
 	return ec
 }
 
-// BridgePacket wires a WebRTC DataChannel with a packet-oriented net.PacketConn (like UDP) bidirectionally.
-func BridgePacket(dc *webrtc.DataChannel, pconn net.PacketConn) <-chan error {
+// stream tracks the flow control window and the half-closes of a bridged
+// stream.
+type stream struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	credit int
+	closed bool
+	// done is closed on shutdown.
+	done chan struct{}
+
+	finSent     bool
+	finReceived bool
+}
+
+// acquire waits until the remote side accepts data and takes up to max bytes
+// of its window. It reports false once the stream is shut down.
+func (s *stream) acquire(max int) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.credit == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return 0, false
+	}
+	n := min(max, s.credit)
+	s.credit -= n
+	return n, true
+}
+
+// release returns unused window taken by acquire.
+func (s *stream) release(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credit += n
+}
+
+// grant adds window received from the remote side.
+func (s *stream) grant(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credit += n
+	s.cond.Broadcast()
+}
+
+// finish records a FIN sent (sent) or received, and reports whether both
+// directions are done.
+func (s *stream) finish(sent bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sent {
+		s.finSent = true
+	} else {
+		s.finReceived = true
+	}
+	return s.finSent && s.finReceived
+}
+
+func (s *stream) finished() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.finSent && s.finReceived
+}
+
+// shutdown wakes up and stops a sender waiting for window.
+func (s *stream) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		close(s.done)
+	}
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// BridgePacket wires a Channel with a packet-oriented net.PacketConn (like UDP) bidirectionally.
+//
+// Every local source address gets its own flow, whose ID prefixes the
+// datagrams sent over ch, and replies carrying that ID are sent back to it.
+// Flows expire after opts.IdleTimeout without traffic. Datagrams over the
+// rate limits of shaper, if not nil, are dropped.
+func BridgePacket(ch *Channel, pconn net.PacketConn, opts FlowOptions, shaper *Shaper) <-chan error {
 	ec := make(chan error, 1)
-	slog.Info("Bridging DataChannel with packet connection", "label", dc.Label(), "localAddr", pconn.LocalAddr().String())
+	slog.Info("Bridging DataChannel with packet connection", "label", ch.Label(), "localAddr", pconn.LocalAddr().String())
 
-	var returnAddr net.Addr
-	var mu sync.RWMutex
+	flows := newFlowTable(opts)
+	done := make(chan struct{})
 
 	var closeOnce sync.Once
 	closeAndSignal := func(err error) {
 		closeOnce.Do(func() {
+			close(done)
 			pconn.Close()
-			dc.Close()
+			ch.Close()
 			if err != nil {
 				ec <- err
 			}
@@ -88,54 +349,274 @@ func BridgePacket(dc *webrtc.DataChannel, pconn net.PacketConn) <-chan error {
 		})
 	}
 
+	// Expire idle flows
+	go func() {
+		ticker := time.NewTicker(flows.opts.IdleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, addr := range flows.expire() {
+					slog.Debug("UDP flow expired", "addr", addr)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
 	// Local -> Remote
 	go func() {
-		buf := make([]byte, 16*1024)
+		buf := bufferPool.Get().(*[]byte)
+		defer bufferPool.Put(buf)
+
 		for {
-			n, addr, err := pconn.ReadFrom(buf)
+			n, addr, err := pconn.ReadFrom((*buf)[flowHeaderSize:])
 			if err != nil {
 				closeAndSignal(fmt.Errorf("read from packet conn: %w", err))
 				return
 			}
 
-			mu.Lock()
-			if returnAddr == nil {
-				slog.Info("setting UDP return address", "addr", addr)
-				returnAddr = addr
+			id, created, err := flows.outbound(addr)
+			if err != nil {
+				slog.Warn("dropping datagram", "from", addr, "err", err)
+				continue
+			}
+			if created {
+				slog.Info("new UDP flow", "addr", addr, "flow", id)
 			}
-			mu.Unlock()
 
-			if n > 0 {
-				if err := dc.Send(buf[:n]); err != nil {
-					closeAndSignal(fmt.Errorf("send to dc: %w", err))
-					return
-				}
+			if ch.Full() {
+				// Datagrams may be lost anyway, drop rather than queue.
+				slog.Debug("data channel buffer full, dropping datagram", "size", n, "from", addr)
+				continue
+			}
+			if !shaper.upload().Allow(flowHeaderSize + n) {
+				slog.Debug("upload rate exceeded, dropping datagram", "size", n, "from", addr)
+				continue
+			}
+			putFlowID(*buf, id)
+			if _, err := ch.Write((*buf)[:flowHeaderSize+n]); err != nil {
+				closeAndSignal(fmt.Errorf("send to dc: %w", err))
+				return
 			}
 		}
 	}()
 
 	// Remote -> Local
-	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		mu.RLock()
-		addr := returnAddr
-		mu.RUnlock()
-
-		if addr == nil {
-			slog.Warn("dropping message, no return address yet for UDP packet")
-			return
+	go func() {
+		buf := bufferPool.Get().(*[]byte)
+		defer bufferPool.Put(buf)
+
+		for {
+			n, err := ch.Read(*buf)
+			if err == io.EOF {
+				slog.Debug("data channel closed")
+				closeAndSignal(nil) // Clean close
+				return
+			}
+			if err != nil {
+				closeAndSignal(fmt.Errorf("read from dc: %w", err))
+				return
+			}
+			if n < flowHeaderSize {
+				slog.Warn("dropping message without flow ID", "size", n)
+				continue
+			}
+
+			if !shaper.download().Allow(n) {
+				slog.Debug("download rate exceeded, dropping datagram", "size", n)
+				continue
+			}
+			id := flowID(*buf)
+			addr := flows.inbound(id)
+			if addr == nil {
+				slog.Debug("dropping datagram for unknown flow", "flow", id)
+				continue
+			}
+			if _, err := pconn.WriteTo((*buf)[flowHeaderSize:n], addr); err != nil {
+				closeAndSignal(fmt.Errorf("write to packet conn: %w", err))
+				return
+			}
 		}
-		if len(msg.Data) == 0 {
-			return
+	}()
+
+	return ec
+}
+
+// BridgeFlows wires a Channel carrying the flows of a BridgePacket on the
+// remote side with a local service. Every flow gets its own socket from dial,
+// usually a connected UDP socket, and datagrams received on it are sent back
+// as part of the flow. Sockets are closed once their flow was idle for
+// opts.IdleTimeout. Datagrams over the rate limits of shaper, if not nil, are
+// dropped.
+func BridgeFlows(ch *Channel, dial func() (net.Conn, error), opts FlowOptions, shaper *Shaper) <-chan error {
+	ec := make(chan error, 1)
+	slog.Info("Bridging DataChannel with flows to the local service", "label", ch.Label())
+
+	opts = opts.withDefaults()
+	done := make(chan struct{})
+
+	type dialedFlow struct {
+		conn     net.Conn
+		lastSeen time.Time
+	}
+	var mu sync.Mutex
+	conns := map[uint32]*dialedFlow{}
+	remove := func(id uint32, conn net.Conn) {
+		mu.Lock()
+		if f, ok := conns[id]; ok && f.conn == conn {
+			delete(conns, id)
+		}
+		mu.Unlock()
+		conn.Close()
+	}
+
+	var closeOnce sync.Once
+	closeAndSignal := func(err error) {
+		closeOnce.Do(func() {
+			close(done)
+			mu.Lock()
+			for id, f := range conns {
+				f.conn.Close()
+				delete(conns, id)
+			}
+			mu.Unlock()
+			ch.Close()
+			if err != nil {
+				ec <- err
+			}
+			close(ec)
+		})
+	}
+
+	// Expire idle flows
+	go func() {
+		ticker := time.NewTicker(opts.IdleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				mu.Lock()
+				for id, f := range conns {
+					if now.Sub(f.lastSeen) > opts.IdleTimeout {
+						slog.Debug("UDP flow expired", "flow", id, "local", f.conn.LocalAddr())
+						f.conn.Close()
+						delete(conns, id)
+					}
+				}
+				mu.Unlock()
+			case <-done:
+				return
+			}
 		}
-		if _, err := pconn.WriteTo(msg.Data, addr); err != nil {
-			closeAndSignal(fmt.Errorf("write to packet conn: %w", err))
+	}()
+
+	// Local -> Remote, for one flow
+	relay := func(id uint32, conn net.Conn) {
+		buf := bufferPool.Get().(*[]byte)
+		defer bufferPool.Put(buf)
+
+		for {
+			n, err := conn.Read((*buf)[flowHeaderSize:])
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// An earlier datagram was refused, the flow goes on.
+				continue
+			}
+			if err != nil {
+				slog.Debug("UDP flow closed", "flow", id, "err", err)
+				remove(id, conn)
+				return
+			}
+
+			mu.Lock()
+			if f, ok := conns[id]; ok {
+				f.lastSeen = time.Now()
+			}
+			mu.Unlock()
+
+			if ch.Full() {
+				// Datagrams may be lost anyway, drop rather than queue.
+				slog.Debug("data channel buffer full, dropping datagram", "size", n, "flow", id)
+				continue
+			}
+			if !shaper.upload().Allow(flowHeaderSize + n) {
+				slog.Debug("upload rate exceeded, dropping datagram", "size", n, "flow", id)
+				continue
+			}
+			putFlowID(*buf, id)
+			if _, err := ch.Write((*buf)[:flowHeaderSize+n]); err != nil {
+				closeAndSignal(fmt.Errorf("send to dc: %w", err))
+				return
+			}
 		}
-	})
+	}
 
-	dc.OnClose(func() {
-		slog.Debug("data channel closed")
-		closeAndSignal(nil) // Clean close
-	})
+	// Remote -> Local
+	go func() {
+		buf := bufferPool.Get().(*[]byte)
+		defer bufferPool.Put(buf)
+
+		for {
+			n, err := ch.Read(*buf)
+			if err == io.EOF {
+				slog.Debug("data channel closed")
+				closeAndSignal(nil) // Clean close
+				return
+			}
+			if err != nil {
+				closeAndSignal(fmt.Errorf("read from dc: %w", err))
+				return
+			}
+			if n < flowHeaderSize {
+				slog.Warn("dropping message without flow ID", "size", n)
+				continue
+			}
+
+			if !shaper.download().Allow(n) {
+				slog.Debug("download rate exceeded, dropping datagram", "size", n)
+				continue
+			}
+			id := flowID(*buf)
+			mu.Lock()
+			f, ok := conns[id]
+			if ok {
+				f.lastSeen = time.Now()
+			}
+			flows := len(conns)
+			mu.Unlock()
+			if !ok && flows >= opts.MaxFlows {
+				slog.Warn("dropping datagram", "flow", id, "err", errTooManyFlows)
+				continue
+			}
+			if !ok {
+				// Dial without holding mu, which the relays and the expiry
+				// need. Only this loop adds flows, so id is still new after.
+				conn, err := dial()
+				if err != nil {
+					slog.Warn("dropping datagram, failed to dial local service", "flow", id, "err", err)
+					continue
+				}
+				mu.Lock()
+				select {
+				case <-done:
+					mu.Unlock()
+					conn.Close()
+					return
+				default:
+				}
+				slog.Info("new UDP flow", "flow", id, "local", conn.LocalAddr())
+				f = &dialedFlow{conn: conn, lastSeen: time.Now()}
+				conns[id] = f
+				mu.Unlock()
+				go relay(id, conn)
+			}
+
+			if _, err := f.conn.Write((*buf)[flowHeaderSize:n]); err != nil {
+				slog.Debug("failed to write datagram to local service", "flow", id, "err", err)
+			}
+		}
+	}()
 
 	return ec
 }
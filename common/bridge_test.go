@@ -0,0 +1,203 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v3/vnet"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// channelPair connects two in-process peer connections and returns both ends
+// of a data channel between them, opened with spec.
+func channelPair(tb testing.TB, detached bool, spec ChannelSpec) (*Channel, *Channel) {
+	a, b := apiPair(tb, detached, 0)
+	local, remote := channelPairs(tb, a, b, detached, 1, spec)
+	return local[0], remote[0]
+}
+
+// apiPair returns the APIs of two in-process peers. When delay is not zero
+// they talk over a virtual network delaying every packet by it.
+func apiPair(tb testing.TB, detached bool, delay time.Duration) (*webrtc.API, *webrtc.API) {
+	tb.Helper()
+
+	var wan *vnet.Router
+	if delay > 0 {
+		var err error
+		wan, err = vnet.NewRouter(&vnet.RouterConfig{
+			CIDR:          "10.0.0.0/24",
+			MinDelay:      delay,
+			LoggerFactory: logging.NewDefaultLoggerFactory(),
+		})
+		require.NoError(tb, err)
+	}
+
+	newAPI := func(ip string) *webrtc.API {
+		se := webrtc.SettingEngine{}
+		if detached {
+			se.DetachDataChannels()
+		}
+		if wan != nil {
+			nw, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+			require.NoError(tb, err)
+			require.NoError(tb, wan.AddNet(nw))
+			se.SetNet(nw)
+		}
+		return webrtc.NewAPI(webrtc.WithSettingEngine(se))
+	}
+	a, b := newAPI("10.0.0.1"), newAPI("10.0.0.2")
+
+	if wan != nil {
+		require.NoError(tb, wan.Start())
+		tb.Cleanup(func() { wan.Stop() })
+	}
+	return a, b
+}
+
+// channelPairs connects two peer connections of a and b and returns both
+// ends of n data channels between them, opened with spec, in the same order.
+func channelPairs(tb testing.TB, a, b *webrtc.API, detached bool, n int, spec ChannelSpec) ([]*Channel, []*Channel) {
+	tb.Helper()
+
+	offerer, err := a.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(tb, err)
+	tb.Cleanup(func() { offerer.Close() })
+	answerer, err := b.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(tb, err)
+	tb.Cleanup(func() { answerer.Close() })
+
+	remoteC := make(chan *Channel, n)
+	answerer.OnDataChannel(func(dc *webrtc.DataChannel) {
+		remoteC <- newChannel(dc, detached)
+	})
+	protocol := spec.Encode()
+	local := make([]*Channel, n)
+	for i := range local {
+		dc, err := offerer.CreateDataChannel(fmt.Sprint("bench-", i), &webrtc.DataChannelInit{Protocol: &protocol})
+		require.NoError(tb, err)
+		local[i] = newChannel(dc, detached)
+	}
+
+	offer, err := offerer.CreateOffer(nil)
+	require.NoError(tb, err)
+	require.NoError(tb, offerer.SetLocalDescription(offer))
+	<-webrtc.GatheringCompletePromise(offerer)
+	require.NoError(tb, answerer.SetRemoteDescription(*offerer.LocalDescription()))
+
+	answer, err := answerer.CreateAnswer(nil)
+	require.NoError(tb, err)
+	require.NoError(tb, answerer.SetLocalDescription(answer))
+	<-webrtc.GatheringCompletePromise(answerer)
+	require.NoError(tb, offerer.SetRemoteDescription(*answerer.LocalDescription()))
+
+	remote := make([]*Channel, n)
+	for range n {
+		r := <-remoteC
+		var i int
+		_, err := fmt.Sscanf(r.Label(), "bench-%d", &i)
+		require.NoError(tb, err)
+		remote[i] = r
+	}
+	for i := range n {
+		<-local[i].Opened()
+		<-remote[i].Opened()
+	}
+	return local, remote
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(tb, err)
+	peer := <-accepted
+	require.NotNil(tb, peer)
+	tb.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+
+	return conn, peer
+}
+
+// bridgePair bridges a stream over local and remote and returns the local
+// connections of both sides, as the client and the service see them, and the
+// results of both bridges.
+func bridgePair(tb testing.TB, local, remote MessageChannel) (src, dst net.Conn, srcErr, dstErr <-chan error) {
+	src, srcBridge := tcpPair(tb)
+	dstBridge, dst := tcpPair(tb)
+	srcErr = BridgeStream(local, srcBridge, nil)
+	dstErr = BridgeStream(remote, dstBridge, nil)
+	return src, dst, srcErr, dstErr
+}
+
+func benchmarkBridgeStream(b *testing.B, detached bool) {
+	local, remote := channelPair(b, detached, ChannelSpec{})
+	benchmarkBridge(b, local, remote)
+}
+
+// benchmarkBridge measures the throughput of a stream bridged over local and
+// remote.
+func benchmarkBridge(b *testing.B, local, remote MessageChannel) {
+	src, dst, _, _ := bridgePair(b, local, remote)
+
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+
+	go func() {
+		for range b.N {
+			if _, err := src.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	_, err := io.CopyN(io.Discard, dst, int64(b.N*len(chunk)))
+	require.NoError(b, err)
+}
+
+// BenchmarkBridgeStream compares the throughput of a stream bridged through
+// attached (callback) and detached data channels.
+func BenchmarkBridgeStream(b *testing.B) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	b.Run("callback", func(b *testing.B) { benchmarkBridgeStream(b, false) })
+	b.Run("detached", func(b *testing.B) { benchmarkBridgeStream(b, true) })
+}
+
+// BenchmarkBridgeStriped shows how the throughput of a stream over a link
+// with a 50ms delay scales with the number of peer connections it is striped
+// over, as the window of a single channel only fills the link for so long.
+// With -benchtime=300x or more, SCTP slow start weighs less in the results.
+func BenchmarkBridgeStriped(b *testing.B) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	for _, n := range []int{1, 2, 4} {
+		b.Run(fmt.Sprint("peers=", n), func(b *testing.B) {
+			a, z := apiPair(b, false, 50*time.Millisecond)
+			var local, remote []*Channel
+			for range n {
+				l, r := channelPairs(b, a, z, false, 1, ChannelSpec{})
+				local = append(local, l...)
+				remote = append(remote, r...)
+			}
+			benchmarkBridge(b, NewStriped(local), NewStriped(remote))
+		})
+	}
+}
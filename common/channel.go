@@ -0,0 +1,317 @@
+package common
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ControlLabel is the label of the channel that a client keeps open for the
+// lifetime of a session that carries a data channel per connection. The
+// session ends when it closes.
+const ControlLabel = "control"
+
+// MessageChannel is a message-oriented channel that a stream can be bridged
+// over: a Channel or several channels striped together.
+type MessageChannel interface {
+	// Read reads the next message and Write sends p as one message.
+	io.ReadWriteCloser
+	// Label names the channel in logs.
+	Label() string
+	// Spec returns the spec the channel was opened with.
+	Spec() (ChannelSpec, error)
+	// Flush waits until queued messages were delivered.
+	Flush(timeout time.Duration)
+
+	// send sends p as one message without waiting for the queue to drain.
+	send(p []byte) error
+	// window is how much data a stream over the channel may have in flight.
+	window() int
+	// queued returns how much data is queued on the channel.
+	queued() uint64
+}
+
+// flushInterval is how often Flush checks whether queued data was sent.
+const flushInterval = 10 * time.Millisecond
+
+// Channel is a DataChannel seen as a message-oriented io.ReadWriteCloser:
+// every Write sends one message and every Read returns one message. Writes
+// block while too much data is queued on the DataChannel.
+//
+// A channel is either detached, reading and writing the underlying SCTP
+// stream directly, or attached, receiving messages through the OnMessage
+// callback. Detached channels require a peer connection whose setting engine
+// detaches data channels. They are not faster, as BenchmarkBridgeStream shows,
+// so only the tests and benchmarks use them.
+type Channel struct {
+	dc       *webrtc.DataChannel
+	detached bool
+
+	// opened is closed once the channel is open. rwc and err are set before
+	// and only read after.
+	opened chan struct{}
+	rwc    io.ReadWriteCloser
+	err    error
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Attached channels only: the messages received by the OnMessage
+	// callback, queued for Read so that the callback never holds up the read
+	// loop of the peer connection, which all of its channels share.
+	mu         sync.Mutex
+	msgs       [][]byte
+	queuedSize int
+	arrived    chan struct{}
+
+	drained chan struct{}
+}
+
+// NewChannel wraps dc, which must not be open yet, as an attached channel.
+func NewChannel(dc *webrtc.DataChannel) *Channel {
+	return newChannel(dc, false)
+}
+
+func newChannel(dc *webrtc.DataChannel, detached bool) *Channel {
+	c := &Channel{
+		dc:       dc,
+		detached: detached,
+		opened:   make(chan struct{}),
+		closed:   make(chan struct{}),
+		arrived:  make(chan struct{}, 1),
+		drained:  make(chan struct{}, 1),
+	}
+
+	dc.OnOpen(func() {
+		if detached {
+			c.rwc, c.err = dc.Detach()
+		}
+		close(c.opened)
+	})
+	if !detached {
+		dc.OnMessage(c.enqueue)
+	}
+	dc.OnClose(func() {
+		slog.Debug("data channel closed", "label", dc.Label())
+		c.closeOnce.Do(func() { close(c.closed) })
+	})
+
+	dc.SetBufferedAmountLowThreshold(bufferedAmountLow)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case c.drained <- struct{}{}:
+		default:
+		}
+	})
+
+	return c
+}
+
+// maxReceiveQueue is how much data an attached channel queues for Read. The
+// window of a stream keeps it well below that; datagrams beyond it are
+// dropped, as a full socket buffer would.
+const maxReceiveQueue = 2 * streamWindow
+
+// enqueue queues a message received by an attached channel for Read.
+func (c *Channel) enqueue(msg webrtc.DataChannelMessage) {
+	c.mu.Lock()
+	if c.queuedSize+len(msg.Data) > maxReceiveQueue {
+		c.mu.Unlock()
+		slog.Warn("receive queue full, dropping message", "label", c.dc.Label(), "size", len(msg.Data))
+		return
+	}
+	c.msgs = append(c.msgs, msg.Data)
+	c.queuedSize += len(msg.Data)
+	c.mu.Unlock()
+
+	select {
+	case c.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue returns the next queued message, if any.
+func (c *Channel) dequeue() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.msgs) == 0 {
+		return nil, false
+	}
+	msg := c.msgs[0]
+	c.msgs[0] = nil
+	c.msgs = c.msgs[1:]
+	c.queuedSize -= len(msg)
+	return msg, true
+}
+
+// Opened is closed once the channel is open and ready for use.
+func (c *Channel) Opened() <-chan struct{} {
+	return c.opened
+}
+
+// Spec returns the spec the channel was opened with.
+func (c *Channel) Spec() (ChannelSpec, error) {
+	return ParseChannelSpec(c.dc.Protocol())
+}
+
+// Wait discards incoming messages until the channel is closed by either
+// side. Detached channels only learn about the remote side closing them by
+// reading, so Wait is how the control channel of a session is watched.
+func (c *Channel) Wait() error {
+	buf := make([]byte, bufferSize)
+	for {
+		if _, err := c.Read(buf); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// ready waits until the channel is open and returns the error of opening it,
+// or closedErr if the channel is closed first.
+func (c *Channel) ready(closedErr error) error {
+	select {
+	case <-c.opened:
+		return c.err
+	case <-c.closed:
+		select {
+		case <-c.opened:
+			return c.err
+		default:
+			return closedErr
+		}
+	}
+}
+
+// Label returns the label of the underlying DataChannel.
+func (c *Channel) Label() string {
+	return c.dc.Label()
+}
+
+// Read reads the next message into p, which must be large enough to hold it,
+// waiting for the channel to open first. It returns io.EOF once the channel
+// is closed.
+func (c *Channel) Read(p []byte) (int, error) {
+	if err := c.ready(io.EOF); err != nil {
+		return 0, err
+	}
+	if c.detached {
+		n, err := c.rwc.Read(p)
+		if err == io.EOF {
+			// The remote side closed the channel, which detached channels
+			// are not told about otherwise.
+			c.closeOnce.Do(func() { close(c.closed) })
+		}
+		return n, err
+	}
+
+	for {
+		if msg, ok := c.dequeue(); ok {
+			if len(msg) > len(p) {
+				return 0, io.ErrShortBuffer
+			}
+			return copy(p, msg), nil
+		}
+		select {
+		case <-c.arrived:
+		case <-c.closed:
+			// Deliver what arrived before the channel was closed.
+			if msg, ok := c.dequeue(); ok {
+				if len(msg) > len(p) {
+					return 0, io.ErrShortBuffer
+				}
+				return copy(p, msg), nil
+			}
+			return 0, io.EOF
+		}
+	}
+}
+
+// Write sends p as one message. Once more than bufferedAmountHigh bytes are
+// queued it blocks until the queue drained below bufferedAmountLow.
+func (c *Channel) Write(p []byte) (int, error) {
+	if err := c.send(p); err != nil {
+		return 0, err
+	}
+	if err := c.wait(); err != nil {
+		return len(p), err
+	}
+	return len(p), nil
+}
+
+// wait blocks while the queue is above bufferedAmountHigh, until it drained
+// below bufferedAmountLow.
+func (c *Channel) wait() error {
+	if c.dc.BufferedAmount() > bufferedAmountHigh {
+		// The remote side is slower than the local one, stop until the data
+		// channel has drained.
+		slog.Debug("data channel buffer full, pausing", "label", c.dc.Label(), "buffered", c.dc.BufferedAmount())
+		for c.dc.BufferedAmount() > bufferedAmountLow {
+			select {
+			case <-c.drained:
+			case <-c.closed:
+				return io.ErrClosedPipe
+			}
+		}
+	}
+	return nil
+}
+
+// send sends p as one message without waiting for the queue to drain. It
+// waits for the channel to open first.
+func (c *Channel) send(p []byte) error {
+	if err := c.ready(io.ErrClosedPipe); err != nil {
+		return err
+	}
+	if c.detached {
+		_, err := c.rwc.Write(p)
+		return err
+	}
+	return c.dc.Send(p)
+}
+
+// Flush waits until the remote side acknowledged all queued data, the channel
+// is closed or timeout elapsed. Closing a channel, and its peer connection,
+// right after the last write may otherwise lose that data.
+func (c *Channel) Flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for c.dc.BufferedAmount() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(flushInterval):
+		}
+	}
+}
+
+func (c *Channel) window() int {
+	return streamWindow
+}
+
+// queued returns how much data is queued on the channel.
+func (c *Channel) queued() uint64 {
+	return c.dc.BufferedAmount()
+}
+
+// Full reports whether so much data is queued that a Write would block.
+func (c *Channel) Full() bool {
+	return c.dc.BufferedAmount() > bufferedAmountHigh
+}
+
+// Close closes the channel.
+func (c *Channel) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	select {
+	case <-c.opened:
+		if c.rwc != nil {
+			return c.rwc.Close()
+		}
+	default:
+	}
+	return c.dc.Close()
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// minCompressSize is the smallest data frame worth compressing.
+	minCompressSize = 64
+	// incompressibleLimit is after how many frames in a row that compression
+	// does not shrink by at least an eighth a stream stops compressing.
+	incompressibleLimit = 4
+	// incompressibleSkip is how many frames are then sent uncompressed before
+	// compression is tried again.
+	incompressibleSkip = 256
+)
+
+// CompressionStats counts the stream data sent by bridges of compressed
+// channels.
+type CompressionStats struct {
+	// Uncompressed is the size of the data sent in compressed frames.
+	Uncompressed uint64
+	// Compressed is the size of those frames once compressed.
+	Compressed uint64
+	// Skipped is the size of the data sent uncompressed because it did not
+	// compress well.
+	Skipped uint64
+}
+
+func (s CompressionStats) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("uncompressed", s.Uncompressed),
+		slog.Uint64("compressed", s.Compressed),
+		slog.Uint64("skipped", s.Skipped),
+	)
+}
+
+var compressionTotals struct {
+	uncompressed, compressed, skipped atomic.Uint64
+}
+
+// Compression returns the totals of all compressed channels of the process.
+func Compression() CompressionStats {
+	return CompressionStats{
+		Uncompressed: compressionTotals.uncompressed.Load(),
+		Compressed:   compressionTotals.compressed.Load(),
+		Skipped:      compressionTotals.skipped.Load(),
+	}
+}
+
+// compressionReportInterval is how often ReportCompression logs the totals.
+const compressionReportInterval = time.Minute
+
+// ReportCompression logs the totals of all compressed channels of the process
+// every minute in which they changed, until ctx is done.
+func ReportCompression(ctx context.Context) {
+	t := time.NewTicker(compressionReportInterval)
+	defer t.Stop()
+
+	var last CompressionStats
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		if stats := Compression(); stats != last {
+			slog.Info("compression totals", "stats", stats)
+			last = stats
+		}
+	}
+}
+
+// Frames are compressed independently of each other, so writers and readers
+// are only needed while a frame is handled and can be shared.
+var (
+	flateWriterPool = sync.Pool{
+		New: func() any {
+			w, _ := flate.NewWriter(nil, flate.BestSpeed)
+			return w
+		},
+	}
+	flateReaderPool = sync.Pool{
+		New: func() any {
+			return flate.NewReader(nil)
+		},
+	}
+)
+
+// compressor compresses the data frames of one stream with DEFLATE, backing
+// off while the data does not compress.
+type compressor struct {
+	buf    bytes.Buffer
+	misses int
+	skip   int
+	stats  CompressionStats
+}
+
+// frame returns the frame to send for the DATA frame msg, which is msg
+// itself unless it was worth compressing. The result is valid until the next
+// call.
+func (c *compressor) frame(msg []byte) []byte {
+	data := msg[1:]
+	if c.skip > 0 || len(data) < minCompressSize {
+		if c.skip > 0 {
+			c.skip--
+		}
+		c.skipped(len(data))
+		return msg
+	}
+
+	c.buf.Reset()
+	c.buf.WriteByte(byte(frameDeflate))
+	w := flateWriterPool.Get().(*flate.Writer)
+	w.Reset(&c.buf)
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	flateWriterPool.Put(w)
+
+	if err != nil || c.buf.Len()-1 > len(data)-len(data)/8 {
+		c.misses++
+		if c.misses >= incompressibleLimit {
+			slog.Debug("stream data does not compress, pausing compression", "frames", incompressibleSkip)
+			c.misses = 0
+			c.skip = incompressibleSkip
+		}
+		c.skipped(len(data))
+		return msg
+	}
+
+	c.misses = 0
+	c.stats.Uncompressed += uint64(len(data))
+	c.stats.Compressed += uint64(c.buf.Len() - 1)
+	compressionTotals.uncompressed.Add(uint64(len(data)))
+	compressionTotals.compressed.Add(uint64(c.buf.Len() - 1))
+	return c.buf.Bytes()
+}
+
+func (c *compressor) skipped(n int) {
+	c.stats.Skipped += uint64(n)
+	compressionTotals.skipped.Add(uint64(n))
+}
+
+var errFrameTooLarge = errors.New("decompressed frame too large")
+
+// decompress decompresses the payload of a DEFLATE frame into dst, which
+// must be larger than messageSize.
+func decompress(dst, payload []byte) (int, error) {
+	r := flateReaderPool.Get().(io.ReadCloser)
+	defer flateReaderPool.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(payload), nil); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r, dst[:messageSize+1])
+	switch {
+	case err == nil:
+		// Frames never carry more than messageSize bytes.
+		return 0, errFrameTooLarge
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return n, nil
+	default:
+		return 0, fmt.Errorf("decompress frame: %w", err)
+	}
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// dataFrame returns a DATA frame carrying data.
+func dataFrame(data []byte) []byte {
+	return append([]byte{byte(frameData)}, data...)
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("wtt compresses stream data frames "), 1000)[:messageSize]
+
+	var c compressor
+	frame := c.frame(dataFrame(data))
+	typ, payload, err := parseFrame(frame)
+	require.NoError(t, err)
+	require.Equal(t, frameDeflate, typ)
+	require.Less(t, len(payload), len(data)/8)
+
+	dst := make([]byte, bufferSize)
+	n, err := decompress(dst, payload)
+	require.NoError(t, err)
+	require.Equal(t, data, dst[:n])
+
+	require.Equal(t, CompressionStats{Uncompressed: uint64(len(data)), Compressed: uint64(len(payload))}, c.stats)
+}
+
+func TestCompressorSkips(t *testing.T) {
+	var c compressor
+
+	// Small frames are not worth compressing.
+	small := dataFrame(bytes.Repeat([]byte{'a'}, minCompressSize-1))
+	require.Equal(t, small, c.frame(small))
+
+	// Random data does not compress, and after a few frames compression is
+	// not even tried for a while.
+	random := make([]byte, 1024)
+	rand.Read(random)
+	for range incompressibleLimit {
+		require.Equal(t, dataFrame(random), c.frame(dataFrame(random)))
+	}
+	require.Equal(t, incompressibleSkip, c.skip)
+
+	compressible := dataFrame(bytes.Repeat([]byte{'a'}, 1024))
+	require.Equal(t, compressible, c.frame(compressible))
+	require.Equal(t, incompressibleSkip-1, c.skip)
+
+	require.Zero(t, c.stats.Compressed)
+	require.Equal(t, uint64(minCompressSize-1+(incompressibleLimit+1)*1024), c.stats.Skipped)
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	require.NoError(t, err)
+	_, err = w.Write(make([]byte, messageSize+1))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	_, err = decompress(make([]byte, bufferSize), buf.Bytes())
+	require.ErrorIs(t, err, errFrameTooLarge)
+
+	_, err = decompress(make([]byte, bufferSize), []byte{0xff, 0xff})
+	require.Error(t, err)
+}
+
+func TestBridgeStreamDeflate(t *testing.T) {
+	forEachMode(t, func(t *testing.T, detached bool) {
+		local, remote := channelPair(t, detached, ChannelSpec{Codec: CodecDeflate})
+		src, dst, srcErr, dstErr := bridgePair(t, local, remote)
+
+		// Compressible and incompressible data both arrive intact, in either
+		// direction.
+		data := bytes.Repeat([]byte("compressible "), 20000)
+		random := make([]byte, 100000)
+		rand.Read(random)
+		data = append(data, random...)
+
+		go func() {
+			src.Write(data)
+			src.(*net.TCPConn).CloseWrite()
+		}()
+		got, err := io.ReadAll(dst)
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+
+		go func() {
+			dst.Write(data)
+			dst.(*net.TCPConn).CloseWrite()
+		}()
+		got, err = io.ReadAll(src)
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+
+		require.NoError(t, <-srcErr)
+		require.NoError(t, <-dstErr)
+		require.NotZero(t, Compression().Compressed)
+	})
+}
@@ -0,0 +1,146 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Every message on a packet channel starts with the ID of the flow the
+// datagram belongs to, so that replies find their way back to the local
+// address that sent the request.
+const flowHeaderSize = 4
+
+const (
+	// DefaultFlowIdleTimeout is how long a flow is kept by default without
+	// datagrams in either direction.
+	DefaultFlowIdleTimeout = 2 * time.Minute
+	// DefaultMaxFlows is the default maximum number of concurrent flows.
+	DefaultMaxFlows = 1024
+)
+
+// FlowOptions limits the UDP flows a packet bridge keeps track of. A flow is
+// the traffic of one local source address.
+type FlowOptions struct {
+	// IdleTimeout is how long a flow is kept without datagrams in either
+	// direction. Zero means DefaultFlowIdleTimeout.
+	IdleTimeout time.Duration
+	// MaxFlows is the maximum number of concurrent flows. Datagrams from new
+	// sources are dropped while it is reached. Zero means DefaultMaxFlows.
+	MaxFlows int
+}
+
+func (o FlowOptions) withDefaults() FlowOptions {
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = DefaultFlowIdleTimeout
+	}
+	if o.MaxFlows <= 0 {
+		o.MaxFlows = DefaultMaxFlows
+	}
+	return o
+}
+
+var errTooManyFlows = errors.New("too many flows")
+
+type flow struct {
+	id       uint32
+	addr     net.Addr
+	lastSeen time.Time
+}
+
+// flowTable maps local source addresses to flow IDs and back, like the
+// mapping table of a NAT.
+type flowTable struct {
+	opts FlowOptions
+
+	mu     sync.Mutex
+	byAddr map[string]*flow
+	byID   map[uint32]*flow
+	nextID uint32
+}
+
+func newFlowTable(opts FlowOptions) *flowTable {
+	return &flowTable{
+		opts:   opts.withDefaults(),
+		byAddr: map[string]*flow{},
+		byID:   map[uint32]*flow{},
+	}
+}
+
+// outbound returns the ID of the flow of addr, creating the flow if needed.
+func (t *flowTable) outbound(addr net.Addr) (id uint32, created bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if f, ok := t.byAddr[addrKey(addr)]; ok {
+		f.lastSeen = now
+		return f.id, false, nil
+	}
+
+	if len(t.byID) >= t.opts.MaxFlows {
+		t.expireLocked(now)
+		if len(t.byID) >= t.opts.MaxFlows {
+			return 0, false, errTooManyFlows
+		}
+	}
+
+	f := &flow{id: t.nextID, addr: addr, lastSeen: now}
+	t.nextID++
+	t.byAddr[addrKey(addr)] = f
+	t.byID[f.id] = f
+	return f.id, true, nil
+}
+
+// inbound returns the address of the flow with id, or nil if there is no
+// such flow or its datagrams come from an unnamed socket.
+func (t *flowTable) inbound(id uint32) net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.byID[id]
+	if !ok {
+		return nil
+	}
+	f.lastSeen = time.Now()
+	return f.addr
+}
+
+// expire removes the flows that have been idle for too long and returns
+// their addresses.
+func (t *flowTable) expire() []net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.expireLocked(time.Now())
+}
+
+func (t *flowTable) expireLocked(now time.Time) []net.Addr {
+	var expired []net.Addr
+	for id, f := range t.byID {
+		if now.Sub(f.lastSeen) > t.opts.IdleTimeout {
+			delete(t.byID, id)
+			delete(t.byAddr, addrKey(f.addr))
+			expired = append(expired, f.addr)
+		}
+	}
+	return expired
+}
+
+// addrKey returns the key of the flow of addr. Datagrams from unnamed unix
+// sockets, which have no address and cannot be replied to, share a flow.
+func addrKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func putFlowID(b []byte, id uint32) {
+	binary.BigEndian.PutUint32(b, id)
+}
+
+func flowID(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
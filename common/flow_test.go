@@ -0,0 +1,128 @@
+package common
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowTable(t *testing.T) {
+	addr := func(port int) net.Addr {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	}
+	flows := newFlowTable(FlowOptions{IdleTimeout: time.Minute, MaxFlows: 2})
+
+	// idle makes the flow of a look idle for d.
+	idle := func(a net.Addr, d time.Duration) {
+		flows.mu.Lock()
+		defer flows.mu.Unlock()
+		f := flows.byAddr[addrKey(a)]
+		f.lastSeen = f.lastSeen.Add(-d)
+	}
+
+	steps := []struct {
+		name string
+		do   func(t *testing.T)
+	}{
+		{"sources get flows of their own", func(t *testing.T) {
+			id, created, err := flows.outbound(addr(1000))
+			require.NoError(t, err)
+			require.True(t, created)
+			require.Equal(t, uint32(0), id)
+			id, created, err = flows.outbound(addr(1001))
+			require.NoError(t, err)
+			require.True(t, created)
+			require.Equal(t, uint32(1), id)
+		}},
+		{"a source keeps its flow", func(t *testing.T) {
+			id, created, err := flows.outbound(addr(1000))
+			require.NoError(t, err)
+			require.False(t, created)
+			require.Equal(t, uint32(0), id)
+		}},
+		{"replies go back to the source", func(t *testing.T) {
+			require.Equal(t, addr(1000).String(), flows.inbound(0).String())
+			require.Equal(t, addr(1001).String(), flows.inbound(1).String())
+			require.Nil(t, flows.inbound(2))
+		}},
+		{"new sources are refused at the limit", func(t *testing.T) {
+			_, _, err := flows.outbound(addr(1002))
+			require.ErrorIs(t, err, errTooManyFlows)
+		}},
+		{"replies keep a flow alive", func(t *testing.T) {
+			idle(addr(1000), 2*time.Minute)
+			idle(addr(1001), 2*time.Minute)
+			flows.inbound(1)
+			require.Equal(t, []net.Addr{addr(1000)}, flows.expire())
+			require.Nil(t, flows.inbound(0))
+		}},
+		{"expired flows make room", func(t *testing.T) {
+			id, created, err := flows.outbound(addr(1002))
+			require.NoError(t, err)
+			require.True(t, created)
+			require.Equal(t, uint32(2), id)
+
+			idle(addr(1001), 2*time.Minute)
+			id, created, err = flows.outbound(addr(1000))
+			require.NoError(t, err)
+			require.True(t, created)
+			require.Equal(t, uint32(3), id)
+			require.Nil(t, flows.inbound(1))
+		}},
+	}
+	for _, step := range steps {
+		t.Run(step.name, step.do)
+	}
+}
+
+func TestBridgePacketFlows(t *testing.T) {
+	local, remote := channelPair(t, false, ChannelSpec{})
+
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	bridgeErr := BridgePacket(local, pconn, FlowOptions{}, nil)
+
+	// The remote side echoes every message, prefixed with its flow ID.
+	go func() {
+		buf := make([]byte, bufferSize)
+		for {
+			n, err := remote.Read(buf)
+			if err != nil {
+				return
+			}
+			reply := append(append([]byte(nil), buf[:flowHeaderSize]...), 'r')
+			reply = append(reply, buf[:n]...)
+			remote.Write(reply)
+		}
+	}()
+
+	// Every client gets the replies to its own datagrams.
+	var clients []net.Conn
+	for range 3 {
+		conn, err := net.Dial("udp", pconn.LocalAddr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	buf := make([]byte, 64)
+	for round := range 2 {
+		for i, conn := range clients {
+			_, err := conn.Write([]byte{byte('a' + i)})
+			require.NoError(t, err)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := conn.Read(buf)
+			require.NoError(t, err)
+
+			// The reply carries the 4-byte flow ID of the client twice: once
+			// to route it, once echoed as the remote side received it.
+			header := make([]byte, flowHeaderSize)
+			putFlowID(header, uint32(i))
+			require.Equal(t, append(append([]byte{'r'}, header...), byte('a'+i)), buf[:n], "round %d", round)
+		}
+	}
+
+	local.Close()
+	<-bridgeErr
+}
@@ -0,0 +1,197 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+)
+
+// frameType is the first byte of every message on a stream channel. It
+// separates stream data from the control frames that carry half-closes,
+// resets and flow control.
+type frameType byte
+
+const (
+	// frameData carries stream data.
+	frameData frameType = iota
+	// frameFIN tells that the sender will not send any more data.
+	frameFIN
+	// frameRST aborts the stream. Its payload is a ResetCode followed by the
+	// reason.
+	frameRST
+	// frameWindow allows the receiver to send as many more bytes of data as
+	// its payload, a big-endian uint32, says.
+	frameWindow
+	// frameDeflate carries stream data compressed with DEFLATE, on channels
+	// whose spec selects CodecDeflate.
+	frameDeflate
+)
+
+func (t frameType) String() string {
+	switch t {
+	case frameData:
+		return "DATA"
+	case frameFIN:
+		return "FIN"
+	case frameRST:
+		return "RST"
+	case frameWindow:
+		return "WINDOW"
+	case frameDeflate:
+		return "DEFLATE"
+	}
+	return fmt.Sprintf("frame(%d)", byte(t))
+}
+
+// ResetCode tells in an RST frame why the stream was reset, so that the other
+// side can pass the failure on without parsing the reason.
+type ResetCode byte
+
+const (
+	ResetGeneral ResetCode = iota
+	// ResetNotAllowed is for destinations or addresses the host refuses.
+	ResetNotAllowed
+	// ResetRefused is for services refusing the connection.
+	ResetRefused
+	ResetNetworkUnreachable
+	// ResetHostUnreachable is also for names that do not resolve.
+	ResetHostUnreachable
+	ResetTimeout
+)
+
+// ErrNotAllowed is wrapped by the errors of requests a peer refuses by
+// policy, which reset streams with ResetNotAllowed.
+var ErrNotAllowed = errors.New("not allowed")
+
+// resetCode returns the code of a stream reset because of err.
+func resetCode(err error) ResetCode {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrNotAllowed):
+		return ResetNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ResetRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ResetNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return ResetHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ResetTimeout
+	}
+	return ResetGeneral
+}
+
+// ResetError is returned by a bridge when the remote side reset the stream.
+type ResetError struct {
+	Code   ResetCode
+	Reason string
+}
+
+// parseReset returns the error an RST frame with payload tells.
+func parseReset(payload []byte) *ResetError {
+	if len(payload) == 0 {
+		return &ResetError{}
+	}
+	return &ResetError{Code: ResetCode(payload[0]), Reason: string(payload[1:])}
+}
+
+func (e *ResetError) Error() string {
+	return "stream reset by remote: " + e.Reason
+}
+
+var errEmptyFrame = errors.New("empty frame")
+
+// parseFrame splits a message into its frame type and payload.
+func parseFrame(msg []byte) (frameType, []byte, error) {
+	if len(msg) == 0 {
+		return 0, nil, errEmptyFrame
+	}
+	return frameType(msg[0]), msg[1:], nil
+}
+
+// sendControl sends a control frame. Control frames skip the backpressure of
+// Channel.Write so that they are never held up behind data.
+func sendControl(ch MessageChannel, typ frameType, payload []byte) error {
+	msg := make([]byte, 1+len(payload))
+	msg[0] = byte(typ)
+	copy(msg[1:], payload)
+	return ch.send(msg)
+}
+
+// sendReset resets the stream because of err.
+func sendReset(ch MessageChannel, err error) error {
+	return sendControl(ch, frameRST, append([]byte{byte(resetCode(err))}, err.Error()...))
+}
+
+func sendWindow(ch MessageChannel, n int) error {
+	return sendControl(ch, frameWindow, binary.BigEndian.AppendUint32(nil, uint32(n)))
+}
+
+// RejectStream resets a stream channel that will not be bridged, telling
+// the remote side why, and closes it.
+func RejectStream(ch MessageChannel, reason error) {
+	slog.Debug("rejecting stream", "label", ch.Label(), "reason", reason)
+	if err := sendReset(ch, reason); err != nil {
+		slog.Debug("failed to send reset", "err", err)
+	}
+	ch.Flush(flushTimeout)
+	ch.Close()
+}
+
+// AcceptStream tells the remote side of the stream channel ch, waiting in
+// AwaitStream, that it is ready, without granting a window, for channels
+// that carry no data but whose opening asks for something, like a remote
+// listen.
+func AcceptStream(ch MessageChannel) error {
+	return sendWindow(ch, 0)
+}
+
+// AwaitStream waits until the remote side of the stream channel ch is ready,
+// which it tells by granting the first window, or reset the stream, in which
+// case it returns the *ResetError. A ready stream is to be bridged over the
+// returned channel instead of ch.
+func AwaitStream(ch MessageChannel) (MessageChannel, error) {
+	buf := make([]byte, bufferSize)
+	n, err := ch.Read(buf)
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.New("data channel closed before the stream was ready")
+		}
+		return nil, err
+	}
+	typ, payload, err := parseFrame(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case frameWindow:
+		return &replayChannel{MessageChannel: ch, first: buf[:n]}, nil
+	case frameRST:
+		return nil, parseReset(payload)
+	default:
+		return nil, fmt.Errorf("unexpected %s frame before the stream was ready", typ)
+	}
+}
+
+// replayChannel returns a message read ahead before those of its channel.
+type replayChannel struct {
+	MessageChannel
+	first []byte
+}
+
+func (c *replayChannel) Read(p []byte) (int, error) {
+	if c.first != nil {
+		if len(c.first) > len(p) {
+			return 0, io.ErrShortBuffer
+		}
+		n := copy(p, c.first)
+		c.first = nil
+		return n, nil
+	}
+	return c.MessageChannel.Read(p)
+}
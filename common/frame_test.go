@@ -0,0 +1,186 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// forEachMode runs test over attached and detached channels.
+func forEachMode(t *testing.T, test func(t *testing.T, detached bool)) {
+	t.Run("callback", func(t *testing.T) { test(t, false) })
+	t.Run("detached", func(t *testing.T) { test(t, true) })
+}
+
+func TestBridgeStreamHalfClose(t *testing.T) {
+	forEachMode(t, func(t *testing.T, detached bool) {
+		local, remote := channelPair(t, detached, ChannelSpec{})
+		src, dst, srcErr, dstErr := bridgePair(t, local, remote)
+
+		_, err := src.Write([]byte("request"))
+		require.NoError(t, err)
+		require.NoError(t, src.(*net.TCPConn).CloseWrite())
+
+		// The service sees the request end, and can still answer it.
+		got, err := io.ReadAll(dst)
+		require.NoError(t, err)
+		require.Equal(t, "request", string(got))
+
+		for range 3 {
+			_, err = dst.Write([]byte("response"))
+			require.NoError(t, err)
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.NoError(t, dst.(*net.TCPConn).CloseWrite())
+
+		got, err = io.ReadAll(src)
+		require.NoError(t, err)
+		require.Equal(t, "responseresponseresponse", string(got))
+
+		require.NoError(t, <-srcErr)
+		require.NoError(t, <-dstErr)
+	})
+}
+
+func TestBridgeStreamReset(t *testing.T) {
+	forEachMode(t, func(t *testing.T, detached bool) {
+		local, remote := channelPair(t, detached, ChannelSpec{})
+		src, dst, srcErr, dstErr := bridgePair(t, local, remote)
+
+		_, err := src.Write([]byte("request"))
+		require.NoError(t, err)
+		buf := make([]byte, 16)
+		_, err = io.ReadFull(dst, buf[:len("request")])
+		require.NoError(t, err)
+
+		// The service aborts its connection, which resets the stream and so
+		// the connection of the client.
+		require.NoError(t, dst.(*net.TCPConn).SetLinger(0))
+		require.NoError(t, dst.Close())
+
+		require.Error(t, <-dstErr)
+		var rst *ResetError
+		require.ErrorAs(t, <-srcErr, &rst)
+		require.Contains(t, rst.Reason, "read from local")
+
+		_, err = src.Read(buf)
+		require.Error(t, err)
+		require.False(t, errors.Is(err, io.EOF), "connection closed instead of reset: %v", err)
+	})
+}
+
+func TestRejectStream(t *testing.T) {
+	forEachMode(t, func(t *testing.T, detached bool) {
+		local, remote := channelPair(t, detached, ChannelSpec{})
+
+		RejectStream(remote, fmt.Errorf("destination %w", ErrNotAllowed))
+
+		_, err := AwaitStream(local)
+		var rst *ResetError
+		require.ErrorAs(t, err, &rst)
+		require.Equal(t, &ResetError{Code: ResetNotAllowed, Reason: "destination not allowed"}, rst)
+	})
+}
+
+func TestResetCode(t *testing.T) {
+	dialErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want ResetCode
+	}{
+		{name: "not allowed", err: fmt.Errorf("target db:5432: %w", fmt.Errorf("destination %w", ErrNotAllowed)), want: ResetNotAllowed},
+		{name: "refused", err: dialErr(syscall.ECONNREFUSED), want: ResetRefused},
+		{name: "network unreachable", err: dialErr(syscall.ENETUNREACH), want: ResetNetworkUnreachable},
+		{name: "no route", err: dialErr(syscall.EHOSTUNREACH), want: ResetHostUnreachable},
+		{name: "unknown name", err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nx.example", IsNotFound: true}}, want: ResetHostUnreachable},
+		{name: "timeout", err: &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, want: ResetTimeout},
+		{name: "other", err: errors.New("no local service"), want: ResetGeneral},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, resetCode(tt.err))
+		})
+	}
+
+	// A real dial to a closed port is refused.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l.Close()
+	_, err = net.Dial("tcp", l.Addr().String())
+	require.Equal(t, ResetRefused, resetCode(err))
+}
+
+func TestBridgeStreamWindowStall(t *testing.T) {
+	forEachMode(t, func(t *testing.T, detached bool) {
+		local, remote := channelPair(t, detached, ChannelSpec{})
+		src, dst, srcErr, dstErr := bridgePair(t, local, remote)
+
+		// Small socket buffers leave the window as what holds most data back
+		// while the service does not read.
+		for _, conn := range []net.Conn{src, dst} {
+			require.NoError(t, conn.(*net.TCPConn).SetReadBuffer(64<<10))
+			require.NoError(t, conn.(*net.TCPConn).SetWriteBuffer(64<<10))
+		}
+
+		data := make([]byte, 8*streamWindow)
+		for i := range data {
+			data[i] = byte(i / 1024)
+		}
+		var written atomic.Int64
+		go func() {
+			for chunk := range chunks(data, 32<<10) {
+				n, err := src.Write(chunk)
+				written.Add(int64(n))
+				if err != nil {
+					return
+				}
+			}
+			src.(*net.TCPConn).CloseWrite()
+		}()
+
+		// The client stalls once the window is used up...
+		var stalled int64
+		require.Eventually(t, func() bool {
+			before := written.Load()
+			time.Sleep(100 * time.Millisecond)
+			stalled = written.Load()
+			return stalled > 0 && stalled == before
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Less(t, stalled, int64(len(data)))
+		require.LessOrEqual(t, local.queued(), uint64(streamWindow+messageSize+1))
+
+		// ...and resumes once the service reads.
+		got, err := io.ReadAll(dst)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, got), "stream data corrupted")
+
+		require.NoError(t, dst.(*net.TCPConn).CloseWrite())
+		require.NoError(t, <-srcErr)
+		require.NoError(t, <-dstErr)
+	})
+}
+
+// chunks yields data in chunks of size.
+func chunks(data []byte, size int) func(yield func([]byte) bool) {
+	return func(yield func([]byte) bool) {
+		for len(data) > 0 {
+			n := min(size, len(data))
+			if !yield(data[:n]) {
+				return
+			}
+			data = data[n:]
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package rtc
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// certificateLifetime is the validity of generated certificates. It is long
+// because the fingerprint is what remote peers pin.
+const certificateLifetime = 10 * 365 * 24 * time.Hour
+
+// UseCertificate makes peer connections created with cfg use the DTLS
+// certificate stored at path, generating and saving one first if the file
+// does not exist yet.
+func UseCertificate(cfg *webrtc.Configuration, path string) error {
+	cert, err := loadCertificate(path)
+	if errors.Is(err, os.ErrNotExist) {
+		cert, err = createCertificate(path)
+	}
+	if err != nil {
+		return fmt.Errorf("certificate %s: %w", path, err)
+	}
+
+	fingerprint, err := Fingerprint(*cert)
+	if err != nil {
+		return err
+	}
+	slog.Info("using certificate", "path", path, "fingerprint", fingerprint)
+
+	cfg.Certificates = []webrtc.Certificate{*cert}
+	return nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of cert in SDP notation.
+func Fingerprint(cert webrtc.Certificate) (string, error) {
+	fingerprints, err := cert.GetFingerprints()
+	if err != nil {
+		return "", err
+	}
+	for _, f := range fingerprints {
+		if f.Algorithm == "sha-256" {
+			return f.Algorithm + " " + strings.ToUpper(f.Value), nil
+		}
+	}
+	return "", errors.New("certificate has no sha-256 fingerprint")
+}
+
+func loadCertificate(path string) (*webrtc.Certificate, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := webrtc.CertificateFromPEM(string(pem))
+	if err != nil {
+		return nil, err
+	}
+	if cert.Expires().Before(time.Now()) {
+		return nil, fmt.Errorf("certificate expired at %s", cert.Expires())
+	}
+	return cert, nil
+}
+
+func createCertificate(path string) (*webrtc.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	cert, err := webrtc.NewCertificate(key, x509.Certificate{
+		Issuer:       pkix.Name{CommonName: "wtt"},
+		Subject:      pkix.Name{CommonName: "wtt"},
+		SerialNumber: serial,
+		NotBefore:    now.Add(-24 * time.Hour),
+		NotAfter:     now.Add(certificateLifetime),
+		Version:      2,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pem, err := cert.PEM()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(pem), 0o600); err != nil {
+		return nil, err
+	}
+	slog.Info("generated new certificate", "path", path)
+
+	return cert, nil
+}
+
+// RemoteFingerprint returns the DTLS fingerprint announced in sd, in the
+// same notation as Fingerprint.
+func RemoteFingerprint(sd webrtc.SessionDescription) (string, error) {
+	for _, line := range strings.Split(sd.SDP, "\r\n") {
+		if value, ok := strings.CutPrefix(line, "a=fingerprint:"); ok {
+			algorithm, fingerprint, _ := strings.Cut(value, " ")
+			return strings.ToLower(algorithm) + " " + strings.ToUpper(fingerprint), nil
+		}
+	}
+	return "", errors.New("session description has no fingerprint")
+}
+
+// ErrFingerprintMismatch is returned by CheckKnownHost when a host presents a
+// different fingerprint than the one recorded for it.
+var ErrFingerprintMismatch = errors.New("host fingerprint does not match known_hosts")
+
+// ErrUnpinnableHost is returned when known_hosts is used with a host that
+// generates a new certificate, and so a new fingerprint, for every connection.
+var ErrUnpinnableHost = errors.New("host has no persistent certificate to pin")
+
+// CheckKnownHost verifies fingerprint against the one recorded for hostID in
+// the known_hosts file at path. Unknown hosts are trusted on first use and
+// recorded. A mismatch is an error unless replace is set, in which case the
+// recorded fingerprint is replaced.
+func CheckKnownHost(path, hostID, fingerprint string, replace bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// Every line is "<host ID> <algorithm> <fingerprint>".
+	var lines []string
+	var known string
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if id, f, ok := strings.Cut(line, " "); ok && id == hostID {
+			known = f
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	switch {
+	case known == fingerprint:
+		slog.Debug("host fingerprint matches known_hosts", "hostID", hostID)
+		return nil
+	case known == "":
+		slog.Info("trusting new host", "hostID", hostID, "fingerprint", fingerprint, "knownHosts", path)
+	case replace:
+		slog.Warn("replacing host fingerprint", "hostID", hostID, "old", known, "new", fingerprint, "knownHosts", path)
+	default:
+		return fmt.Errorf("%w: host %q presented %q but %s records %q", ErrFingerprintMismatch, hostID, fingerprint, path, known)
+	}
+
+	lines = append(lines, hostID+" "+fingerprint)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+}
@@ -0,0 +1,40 @@
+package rtc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckKnownHost(t *testing.T) {
+	const (
+		first  = "sha-256 AA:BB"
+		second = "sha-256 CC:DD"
+	)
+	path := filepath.Join(t.TempDir(), "wtt", "known_hosts")
+
+	// An unknown host is trusted on first use and recorded.
+	require.NoError(t, CheckKnownHost(path, "host-a", first, false))
+	require.NoError(t, CheckKnownHost(path, "host-b", second, false))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "host-a "+first+"\nhost-b "+second+"\n", string(data))
+
+	// A known host must present the recorded fingerprint.
+	require.NoError(t, CheckKnownHost(path, "host-a", first, false))
+	err = CheckKnownHost(path, "host-a", second, false)
+	require.ErrorIs(t, err, ErrFingerprintMismatch)
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "host-a "+first+"\nhost-b "+second+"\n", string(data))
+
+	// Replacing records the new fingerprint and keeps the other hosts.
+	require.NoError(t, CheckKnownHost(path, "host-a", second, true))
+	require.NoError(t, CheckKnownHost(path, "host-a", second, false))
+	require.ErrorIs(t, CheckKnownHost(path, "host-a", first, false), ErrFingerprintMismatch)
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "host-b "+second+"\nhost-a "+second+"\n", string(data))
+}
@@ -0,0 +1,111 @@
+package rtc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+	"wtt/common"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// HTTPOptions configures the HTTP client used for every call to the
+// signaling server.
+type HTTPOptions struct {
+	// Proxy is the URL of the HTTP proxy. When empty the proxy is taken from
+	// the environment (HTTP_PROXY, HTTPS_PROXY and NO_PROXY).
+	Proxy string
+	// CACerts are PEM files with CA certificates trusted in addition to the
+	// system ones.
+	CACerts []string
+	// Headers are added to every request.
+	Headers map[string]string
+	// Timeout bounds every request. It must be longer than common.PollHold,
+	// which the server may take to answer a poll. Zero means no timeout.
+	Timeout time.Duration
+	// Retries is how many times a failed GET or HEAD request is retried,
+	// waiting RetryWait before the first retry and backing off after that.
+	// Offers and answers are not retried, as they may have been delivered.
+	Retries   int
+	RetryWait time.Duration
+}
+
+// NewHTTPClient returns a client for the signaling server at addr.
+func NewHTTPClient(addr string, o HTTPOptions) (*resty.Client, error) {
+	if err := checkHTTPURL(addr); err != nil {
+		return nil, fmt.Errorf("invalid signaling address: %w", err)
+	}
+	if o.Timeout > 0 && o.Timeout <= common.PollHold {
+		return nil, fmt.Errorf("HTTP timeout %s must be longer than the %s the server holds a poll", o.Timeout, common.PollHold)
+	}
+
+	c := resty.New().SetBaseURL(addr)
+
+	if o.Proxy != "" {
+		if err := checkHTTPURL(o.Proxy); err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		c.SetProxy(o.Proxy)
+	}
+
+	if len(o.CACerts) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, path := range o.CACerts {
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", path)
+			}
+		}
+		c.SetTLSClientConfig(&tls.Config{RootCAs: pool})
+	}
+
+	c.SetHeaders(o.Headers)
+	c.SetTimeout(o.Timeout)
+	if o.Retries > 0 {
+		c.SetRetryCount(o.Retries).
+			SetRetryWaitTime(o.RetryWait).
+			SetRetryMaxWaitTime(8 * o.RetryWait).
+			AddRetryCondition(func(r *resty.Response, err error) bool {
+				if err == nil || r == nil || r.Request == nil {
+					return false
+				}
+				return r.Request.Method == http.MethodGet || r.Request.Method == http.MethodHead
+			})
+	}
+
+	return c, nil
+}
+
+// checkHTTPURL checks that s is an absolute http or https URL.
+func checkHTTPURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is not an http or https URL", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", s)
+	}
+	return nil
+}
+
+// IsTimeout reports whether err is a request that timed out, as opposed to
+// one that failed.
+func IsTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,82 @@
+package rtc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		opts    HTTPOptions
+		wantErr bool
+	}{
+		{name: "http", addr: "http://signal.example:8080"},
+		{name: "https", addr: "https://signal.example"},
+		{name: "http proxy", addr: "https://signal.example", opts: HTTPOptions{Proxy: "http://proxy.example:3128"}},
+		{name: "timeout longer than a poll", addr: "https://signal.example", opts: HTTPOptions{Timeout: time.Minute}},
+		{name: "no scheme", addr: "signal.example:8080", wantErr: true},
+		{name: "other scheme", addr: "ws://signal.example", wantErr: true},
+		{name: "no host", addr: "http://", wantErr: true},
+		{name: "unparsable", addr: "http://[::1", wantErr: true},
+		{name: "socks proxy", addr: "https://signal.example", opts: HTTPOptions{Proxy: "socks5://proxy.example:1080"}, wantErr: true},
+		{name: "timeout shorter than a poll", addr: "https://signal.example", opts: HTTPOptions{Timeout: 10 * time.Second}, wantErr: true},
+		{name: "missing CA file", addr: "https://signal.example", opts: HTTPOptions{CACerts: []string{"/nonexistent/ca.pem"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHTTPClient(tt.addr, tt.opts)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestHTTPClientRetries checks that only GET and HEAD requests that failed
+// are retried.
+func TestHTTPClientRetries(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/status" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Fail the request by dropping the connection.
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+
+	hc, err := NewHTTPClient(srv.URL, HTTPOptions{Retries: 2, RetryWait: time.Millisecond})
+	require.NoError(t, err)
+
+	tests := []struct {
+		method string
+		path   string
+		want   int32
+	}{
+		{method: http.MethodGet, path: "/drop", want: 3},
+		{method: http.MethodHead, path: "/drop", want: 3},
+		{method: http.MethodPost, path: "/drop", want: 1},
+		{method: http.MethodGet, path: "/status", want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+tt.path, func(t *testing.T) {
+			requests.Store(0)
+			hc.R().Execute(tt.method, tt.path)
+			require.Equal(t, tt.want, requests.Load())
+		})
+	}
+}
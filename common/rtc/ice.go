@@ -0,0 +1,73 @@
+package rtc
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+	"wtt/common"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ICEOptions holds the ICE settings shared by hosts and clients.
+type ICEOptions struct {
+	// Servers are STUN or TURN server URLs, e.g. turn:turn.example.com:3478.
+	Servers []string
+	// Username and Credential authenticate against the TURN servers.
+	Username   string
+	Credential string
+	// Privacy controls which candidates are exposed to the remote peer.
+	Privacy common.PrivacyMode
+	// RestartGrace is how long a lost connection may take to be restored by
+	// an ICE restart before the peer connection is closed. Zero disables ICE
+	// restarts.
+	RestartGrace time.Duration
+}
+
+// Configure applies o to cfg and se.
+func (o ICEOptions) Configure(cfg *webrtc.Configuration, se *webrtc.SettingEngine) error {
+	for _, url := range o.Servers {
+		server := webrtc.ICEServer{URLs: []string{url}}
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			server.Username = o.Username
+			server.Credential = o.Credential
+		}
+		cfg.ICEServers = append(cfg.ICEServers, server)
+	}
+
+	return ApplyPrivacy(cfg, se, o.Privacy)
+}
+
+// iceTCPNetworkTypes are gathered when ICE-TCP is enabled. UDP stays enabled
+// so that peers without ICE-TCP support can still connect.
+var iceTCPNetworkTypes = []webrtc.NetworkType{
+	webrtc.NetworkTypeUDP4,
+	webrtc.NetworkTypeUDP6,
+	webrtc.NetworkTypeTCP4,
+	webrtc.NetworkTypeTCP6,
+}
+
+// EnableActiveICETCP makes peer connections created with se gather active
+// ICE-TCP candidates, so they can reach a passive ICE-TCP listener when UDP is
+// blocked.
+func EnableActiveICETCP(se *webrtc.SettingEngine) {
+	se.SetNetworkTypes(iceTCPNetworkTypes)
+	se.DisableActiveTCP(false)
+}
+
+// ListenICETCP makes peer connections created with se accept passive ICE-TCP
+// connections on addr. The returned listener is shared by all of them and must
+// be closed by the caller once no more peer connections are needed.
+func ListenICETCP(se *webrtc.SettingEngine, addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("listening for ICE-TCP", "addr", l.Addr())
+
+	se.SetICETCPMux(webrtc.NewICETCPMux(nil, l, 8))
+	se.SetNetworkTypes(iceTCPNetworkTypes)
+
+	return l, nil
+}
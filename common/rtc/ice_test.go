@@ -0,0 +1,58 @@
+package rtc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// TestICETCP connects an active ICE-TCP peer to a passive one over TCP only,
+// through the shared listener.
+func TestICETCP(t *testing.T) {
+	tcpOnly := []webrtc.NetworkType{webrtc.NetworkTypeTCP4}
+
+	passive := webrtc.SettingEngine{}
+	l, err := ListenICETCP(&passive, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	passive.SetNetworkTypes(tcpOnly)
+	passive.SetIncludeLoopbackCandidate(true)
+
+	active := webrtc.SettingEngine{}
+	EnableActiveICETCP(&active)
+	active.SetNetworkTypes(tcpOnly)
+	active.SetIncludeLoopbackCandidate(true)
+
+	offerer, err := webrtc.NewAPI(webrtc.WithSettingEngine(active)).NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer offerer.Close()
+	answerer, err := webrtc.NewAPI(webrtc.WithSettingEngine(passive)).NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer answerer.Close()
+
+	_, err = offerer.CreateDataChannel("control", nil)
+	require.NoError(t, err)
+	offer, err := offerer.CreateOffer(nil)
+	require.NoError(t, err)
+	require.NoError(t, offerer.SetLocalDescription(offer))
+	<-webrtc.GatheringCompletePromise(offerer)
+	require.NoError(t, answerer.SetRemoteDescription(*offerer.LocalDescription()))
+	answer, err := answerer.CreateAnswer(nil)
+	require.NoError(t, err)
+	require.NoError(t, answerer.SetLocalDescription(answer))
+	<-webrtc.GatheringCompletePromise(answerer)
+	require.NoError(t, offerer.SetRemoteDescription(*answerer.LocalDescription()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, WaitConnected(ctx, answerer, 0))
+
+	pair, err := answerer.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	require.NoError(t, err)
+	require.Equal(t, webrtc.ICEProtocolTCP, pair.Local.Protocol)
+	require.Equal(t, uint16(l.Addr().(*net.TCPAddr).Port), pair.Local.Port)
+}
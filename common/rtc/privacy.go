@@ -0,0 +1,91 @@
+package rtc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"wtt/common"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// ApplyPrivacy configures cfg and se so that candidates gathered by the peer
+// connection honour mode.
+func ApplyPrivacy(cfg *webrtc.Configuration, se *webrtc.SettingEngine, mode common.PrivacyMode) error {
+	switch mode {
+	case "", common.PrivacyOff:
+	case common.PrivacyRelayOnly:
+		if !hasTURNServer(cfg.ICEServers) {
+			return fmt.Errorf("privacy mode %q requires a TURN server", mode)
+		}
+		cfg.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	case common.PrivacyNoHost:
+		se.SetICEMulticastDNSMode(ice.MulticastDNSModeQueryAndGather)
+	default:
+		return fmt.Errorf("unsupported privacy mode: %q", mode)
+	}
+	return nil
+}
+
+func hasTURNServer(servers []webrtc.ICEServer) bool {
+	for _, s := range servers {
+		for _, u := range s.URLs {
+			if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LocalSignal builds the signal for the local description of pc. Unless mode
+// is off, host candidates carrying an IP address are removed and the related
+// addresses of the remaining candidates are blanked, so that no local address
+// leaks to the signaling server or the remote peer.
+func LocalSignal(pc *webrtc.PeerConnection, mode common.PrivacyMode) (common.RTCSignal, error) {
+	ld := pc.LocalDescription()
+	if ld == nil {
+		return common.RTCSignal{}, webrtc.ErrConnectionClosed
+	}
+	if mode == "" {
+		mode = common.PrivacyOff
+	}
+
+	signal := common.RTCSignal{SessionDescription: *ld, Privacy: mode}
+	if mode != common.PrivacyOff {
+		signal.SDP = scrubCandidates(signal.SDP)
+	}
+
+	return signal, nil
+}
+
+func scrubCandidates(sdp string) string {
+	lines := strings.Split(sdp, "\r\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			kept = append(kept, line)
+			continue
+		}
+
+		// a=candidate:<foundation> <component> <transport> <priority> <address> <port> typ <type> [raddr <addr> rport <port>] ...
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		if fields[7] == "host" && net.ParseIP(fields[4]) != nil {
+			continue
+		}
+		for i := 8; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "raddr":
+				fields[i+1] = "0.0.0.0"
+			case "rport":
+				fields[i+1] = "0"
+			}
+		}
+		kept = append(kept, strings.Join(fields, " "))
+	}
+	return strings.Join(kept, "\r\n")
+}
@@ -0,0 +1,66 @@
+package rtc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrubCandidates(t *testing.T) {
+	tests := []struct {
+		name      string
+		candidate string
+		want      string
+	}{
+		{
+			name:      "host with IP",
+			candidate: "a=candidate:1 1 udp 2130706431 192.168.1.10 50000 typ host",
+		},
+		{
+			name:      "host with IPv6",
+			candidate: "a=candidate:1 1 udp 2130706431 fd00::10 50000 typ host",
+		},
+		{
+			name:      "host with mDNS name",
+			candidate: "a=candidate:1 1 udp 2130706431 0b0a7c05-6f9c-4d3e-8c8e-3c1f0d7e9a11.local 50000 typ host",
+			want:      "a=candidate:1 1 udp 2130706431 0b0a7c05-6f9c-4d3e-8c8e-3c1f0d7e9a11.local 50000 typ host",
+		},
+		{
+			name:      "srflx",
+			candidate: "a=candidate:2 1 udp 1694498815 203.0.113.7 61000 typ srflx raddr 192.168.1.10 rport 50000",
+			want:      "a=candidate:2 1 udp 1694498815 203.0.113.7 61000 typ srflx raddr 0.0.0.0 rport 0",
+		},
+		{
+			name:      "relay with extensions",
+			candidate: "a=candidate:3 1 udp 16777215 198.51.100.2 3478 typ relay raddr 203.0.113.7 rport 61000 generation 0",
+			want:      "a=candidate:3 1 udp 16777215 198.51.100.2 3478 typ relay raddr 0.0.0.0 rport 0 generation 0",
+		},
+		{
+			name:      "tcp srflx",
+			candidate: "a=candidate:4 1 tcp 1694498815 203.0.113.7 9 typ srflx raddr 10.0.0.5 rport 9 tcptype active",
+			want:      "a=candidate:4 1 tcp 1694498815 203.0.113.7 9 typ srflx raddr 0.0.0.0 rport 0 tcptype active",
+		},
+		{
+			name:      "truncated",
+			candidate: "a=candidate:5 1 udp 2130706431 192.168.1.10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head := []string{"v=0", "m=application 9 UDP/DTLS/SCTP webrtc-datachannel"}
+			tail := []string{"a=end-of-candidates", ""}
+
+			lines := append(append(append([]string{}, head...), tt.candidate), tail...)
+			want := append([]string{}, head...)
+			if tt.want != "" {
+				want = append(want, tt.want)
+			}
+			want = append(want, tail...)
+
+			got := scrubCandidates(strings.Join(lines, "\r\n"))
+			require.Equal(t, strings.Join(want, "\r\n"), got)
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package rtc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Reliability is how a UDP tunnel delivers datagrams over its data channel.
+// The zero value sends every datagram once, unordered, like UDP does.
+type Reliability struct {
+	// Reliable delivers every datagram in order, retransmitting lost ones at
+	// the cost of head-of-line blocking.
+	Reliable bool
+	// MaxPacketLifeTime, when not zero, retransmits lost datagrams for at
+	// most this long, out of order. It is limited to about a minute.
+	MaxPacketLifeTime time.Duration
+}
+
+// Init returns the data channel parameters for r.
+func (r Reliability) Init() (*webrtc.DataChannelInit, error) {
+	if r.Reliable {
+		if r.MaxPacketLifeTime != 0 {
+			return nil, errors.New("a reliable channel has no packet lifetime")
+		}
+		return nil, nil
+	}
+
+	ordered := false
+	if r.MaxPacketLifeTime != 0 {
+		ms := r.MaxPacketLifeTime.Milliseconds()
+		if ms <= 0 || ms > math.MaxUint16 {
+			return nil, fmt.Errorf("invalid max packet lifetime %s: must be between 1ms and %dms", r.MaxPacketLifeTime, math.MaxUint16)
+		}
+		lifetime := uint16(ms)
+		return &webrtc.DataChannelInit{Ordered: &ordered, MaxPacketLifeTime: &lifetime}, nil
+	}
+	retransmits := uint16(0)
+	return &webrtc.DataChannelInit{Ordered: &ordered, MaxRetransmits: &retransmits}, nil
+}
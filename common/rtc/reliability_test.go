@@ -0,0 +1,41 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReliabilityInit(t *testing.T) {
+	ordered := false
+	zero := uint16(0)
+	lifetime := uint16(1500)
+
+	tests := []struct {
+		name    string
+		r       Reliability
+		want    *webrtc.DataChannelInit
+		wantErr bool
+	}{
+		{name: "unreliable", want: &webrtc.DataChannelInit{Ordered: &ordered, MaxRetransmits: &zero}},
+		{name: "reliable", r: Reliability{Reliable: true}},
+		{name: "lifetime", r: Reliability{MaxPacketLifeTime: 1500 * time.Millisecond}, want: &webrtc.DataChannelInit{Ordered: &ordered, MaxPacketLifeTime: &lifetime}},
+		{name: "reliable with lifetime", r: Reliability{Reliable: true, MaxPacketLifeTime: time.Second}, wantErr: true},
+		{name: "lifetime too short", r: Reliability{MaxPacketLifeTime: time.Microsecond}, wantErr: true},
+		{name: "lifetime too long", r: Reliability{MaxPacketLifeTime: 66 * time.Second}, wantErr: true},
+		{name: "negative lifetime", r: Reliability{MaxPacketLifeTime: -time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			init, err := tt.r.Init()
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, init)
+		})
+	}
+}
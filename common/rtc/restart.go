@@ -0,0 +1,75 @@
+package rtc
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// MonitorICE watches the ICE connection of pc. Every time the connection is
+// lost after it was first established, onLost (if not nil) is called in its
+// own goroutine, which is where the offerer should run an ICE restart. If the
+// connection is not restored within grace, pc is closed. With a zero grace, pc
+// is closed once pion gives the connection up as failed, as pion itself never
+// closes it. The returned channel is closed once pc is closed.
+func MonitorICE(pc *webrtc.PeerConnection, grace time.Duration, onLost func()) <-chan struct{} {
+	closed := make(chan struct{})
+
+	var mu sync.Mutex
+	var timer *time.Timer
+	// pc may be connected already when it is first watched.
+	state := pc.ICEConnectionState()
+	connected := state == webrtc.ICEConnectionStateConnected || state == webrtc.ICEConnectionStateCompleted
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		slog.Debug("ICE connection state changed", "state", state)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch state {
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+			connected = true
+			if timer != nil {
+				slog.Info("ICE connection restored")
+				timer.Stop()
+				timer = nil
+			}
+		case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
+			if !connected {
+				// Failures of the initial connection are up to the caller.
+				return
+			}
+			if grace <= 0 {
+				slog.Warn("ICE connection lost", "state", state)
+				if state == webrtc.ICEConnectionStateFailed {
+					// The handler runs on the ICE agent, which Close waits for.
+					go pc.Close()
+					return
+				}
+			} else if timer == nil {
+				slog.Warn("ICE connection lost", "state", state, "grace", grace)
+				timer = time.AfterFunc(grace, func() {
+					slog.Error("ICE connection not restored within grace period, closing", "grace", grace)
+					pc.Close()
+				})
+			}
+			if onLost != nil {
+				go onLost()
+			}
+		case webrtc.ICEConnectionStateClosed:
+			if timer != nil {
+				timer.Stop()
+				timer = nil
+			}
+			select {
+			case <-closed:
+			default:
+				close(closed)
+			}
+		}
+	})
+
+	return closed
+}
@@ -1,6 +1,7 @@
 package rtc
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
@@ -11,20 +12,20 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
-func CreatePeerConnection(cfg webrtc.Configuration) (*webrtc.PeerConnection, error) {
-	pc, err := webrtc.NewPeerConnection(cfg)
+func CreatePeerConnection(cfg webrtc.Configuration, se webrtc.SettingEngine) (*webrtc.PeerConnection, error) {
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(se)).NewPeerConnection(cfg)
 	if err != nil {
 		return nil, err
 	}
 	return pc, nil
 }
 
-func CreateDataChannel(pc *webrtc.PeerConnection, label string) (*webrtc.DataChannel, error) {
+func CreateDataChannel(pc *webrtc.PeerConnection, label string, init *webrtc.DataChannelInit) (*webrtc.DataChannel, error) {
 	if len(label) == 0 {
 		slog.Warn("DataChannel label is empty, using default 'data'")
 		label = "data"
 	}
-	dc, err := pc.CreateDataChannel(label, nil)
+	dc, err := pc.CreateDataChannel(label, init)
 	if err != nil {
 		return nil, err
 	}
@@ -39,8 +40,8 @@ func SetRemoteDescription(pc *webrtc.PeerConnection, desc webrtc.SessionDescript
 	return pc.SetRemoteDescription(desc)
 }
 
-func RegisterHost(c *resty.Client, hostID string) error {
-	res, err := c.R().Head("/" + string(common.RTCRegisterType) + "/" + hostID)
+func RegisterHost(ctx context.Context, c *resty.Client, hostID string) error {
+	res, err := c.R().SetContext(ctx).Head("/" + string(common.RTCRegisterType) + "/" + hostID)
 	if err != nil {
 		return err
 	}
@@ -49,10 +50,10 @@ func RegisterHost(c *resty.Client, hostID string) error {
 	return nil
 }
 
-func SendRTCEvent[T common.RTCEventType](c *resty.Client, typ T, hostID string, signal webrtc.SessionDescription) error {
+func SendRTCEvent[T common.RTCEventType](ctx context.Context, c *resty.Client, typ T, hostID string, signal common.RTCSignal) error {
 	slog.Debug("sending signal", "server", c.BaseURL, "type", typ, "hostID", hostID)
 
-	res, err := c.R().SetBody(signal).Post("/" + string(typ) + "/" + hostID)
+	res, err := c.R().SetContext(ctx).SetBody(signal).Post("/" + string(typ) + "/" + hostID)
 	if err != nil {
 		return err
 	}
@@ -64,19 +65,33 @@ func SendRTCEvent[T common.RTCEventType](c *resty.Client, typ T, hostID string,
 	return nil
 }
 
-func ReceiveRTCEvent[T common.RTCEventType](c *resty.Client, typ T, hostID string) (*webrtc.SessionDescription, error) {
-	slog.Debug("receiving signal", "server", c.BaseURL, "type", typ, "hostID", hostID)
+// ReceiveRTCEvent waits for the next signal of typ for hostID. A non-empty
+// session only receives the signals of that session.
+func ReceiveRTCEvent[T common.RTCEventType](ctx context.Context, c *resty.Client, typ T, hostID, session string) (*common.RTCSignal, error) {
+	slog.Debug("receiving signal", "server", c.BaseURL, "type", typ, "hostID", hostID, "session", session)
 
-	res, err := c.R().Get("/" + string(typ) + "/" + hostID)
-	if err != nil {
-		return nil, err
+	req := c.R().SetContext(ctx)
+	if session != "" {
+		req.SetQueryParam("session", session)
+	}
+	var res *resty.Response
+	for {
+		var err error
+		if res, err = req.Get("/" + string(typ) + "/" + hostID); err != nil {
+			return nil, err
+		}
+		if res.StatusCode() != http.StatusNoContent {
+			break
+		}
+		// The server held the poll as long as it does, poll again.
+		slog.Debug("no signal received, polling again", "type", typ)
 	}
 	if res.StatusCode() != http.StatusOK {
 		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode())
 	}
 	slog.Debug("signal received", "type", typ)
 
-	var signal webrtc.SessionDescription
+	var signal common.RTCSignal
 	if err := json.Unmarshal(res.Body(), &signal); err != nil {
 		return nil, err
 	}
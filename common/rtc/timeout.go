@@ -0,0 +1,102 @@
+package rtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Timeouts bounds the phases of establishing a peer connection. A zero value
+// means that phase has no deadline.
+type Timeouts struct {
+	// Gather bounds ICE candidate gathering.
+	Gather time.Duration
+	// Signal bounds an exchange with the signaling server.
+	Signal time.Duration
+	// ICE bounds connection establishment once descriptions were exchanged.
+	ICE time.Duration
+	// Open bounds the opening of a data channel.
+	Open time.Duration
+}
+
+// WithTimeout is context.WithTimeout, except that a zero d adds no deadline.
+func WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// PhaseError describes err, returned while waiting for phase, turning a
+// deadline into a message naming the phase and its timeout.
+func PhaseError(phase string, d time.Duration, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%s did not complete within %s", phase, d)
+	}
+	return fmt.Errorf("%s: %w", phase, err)
+}
+
+// Gather waits until ICE gathering of pc is complete.
+func Gather(ctx context.Context, pc *webrtc.PeerConnection, d time.Duration) error {
+	ctx, cancel := WithTimeout(ctx, d)
+	defer cancel()
+
+	select {
+	case <-webrtc.GatheringCompletePromise(pc):
+		return nil
+	case <-ctx.Done():
+		return PhaseError("ICE gathering", d, ctx.Err())
+	}
+}
+
+// WaitConnected waits until pc is connected. A failed or closed peer
+// connection is reported as an error describing the state of ICE. It takes
+// over the connection state handler of pc, which nothing else uses, as
+// MonitorICE watches the ICE connection state instead.
+func WaitConnected(ctx context.Context, pc *webrtc.PeerConnection, d time.Duration) error {
+	ctx, cancel := WithTimeout(ctx, d)
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	pc.OnConnectionStateChange(func(webrtc.PeerConnectionState) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer pc.OnConnectionStateChange(nil)
+
+	for {
+		// The state is read after the handler is set, so no change is missed.
+		switch state := pc.ConnectionState(); state {
+		case webrtc.PeerConnectionStateConnected:
+			return nil
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			return fmt.Errorf("peer connection %s (%s)", state, describeICE(pc))
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("%w (%s)", PhaseError("ICE connection", d, ctx.Err()), describeICE(pc))
+		}
+	}
+}
+
+// describeICE summarises what ICE had to work with, which usually tells why
+// a connection could not be established.
+func describeICE(pc *webrtc.PeerConnection) string {
+	count := func(sd *webrtc.SessionDescription) int {
+		if sd == nil {
+			return 0
+		}
+		return strings.Count(sd.SDP, "a=candidate:")
+	}
+
+	return fmt.Sprintf("ICE state %s, %d local and %d remote candidates",
+		pc.ICEConnectionState(), count(pc.LocalDescription()), count(pc.RemoteDescription()))
+}
@@ -0,0 +1,222 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is a data rate in bytes per second.
+type Rate int64
+
+var rateUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30},
+	{"K", 1e3}, {"M", 1e6}, {"G", 1e9},
+}
+
+// UnmarshalText parses a rate like 500K or 1.5Mi, in bytes per second.
+// Decimal (K, M, G) and binary (Ki, Mi, Gi) suffixes are understood, and a
+// trailing B or B/s is ignored.
+func (r *Rate) UnmarshalText(text []byte) error {
+	s := strings.TrimSuffix(strings.TrimSuffix(string(text), "/s"), "B")
+	factor := 1.0
+	for _, u := range rateUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, factor = strings.TrimSuffix(s, u.suffix), u.factor
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	v *= factor
+	// NaN fails every comparison, so only finite rates in range get through.
+	if err != nil || !(v >= 0 && v < math.MaxInt64) {
+		return fmt.Errorf("invalid rate %q", text)
+	}
+	*r = Rate(v)
+	return nil
+}
+
+func (r Rate) String() string {
+	return strconv.FormatInt(int64(r), 10) + "B/s"
+}
+
+// Limiter is a token bucket limiting the data rate of all bridges it is
+// shared by. A nil Limiter does not limit.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter for rate, or nil if rate is not positive.
+func NewLimiter(rate Rate) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	// Allow a quarter of a second worth of data at once, but at least a
+	// full message.
+	burst := max(float64(rate)/4, messageSize)
+	return &Limiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take takes n tokens and returns how long to wait until any debt is paid off.
+// If there are not enough tokens, it goes into debt when allowDebt is true,
+// and takes nothing and reports false otherwise. A full bucket is always
+// enough, so that n larger than the burst can pass at all.
+func (l *Limiter) take(n int, allowDebt bool) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	if l.tokens < min(float64(n), l.burst) && !allowDebt {
+		return 0, false
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0, true
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), true
+}
+
+// Wait blocks until n bytes may pass or done is closed. It reports whether
+// the bytes may pass.
+func (l *Limiter) Wait(n int, done <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+	d, _ := l.take(n, true)
+	if d == 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// Allow reports whether n bytes may pass now. Datagrams that may not are
+// dropped, as a router policing the rate would.
+func (l *Limiter) Allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	_, ok := l.take(n, false)
+	return ok
+}
+
+// Priority is the scheduling class of a stream.
+type Priority string
+
+const (
+	// PriorityAuto treats a stream as interactive until it sent
+	// autoBulkThreshold bytes, and as bulk from then on.
+	PriorityAuto        Priority = "auto"
+	PriorityInteractive Priority = "interactive"
+	PriorityBulk        Priority = "bulk"
+)
+
+const (
+	// autoBulkThreshold is how much data a stream of PriorityAuto sends
+	// before it counts as bulk.
+	autoBulkThreshold = 1 << 20
+	// bulkQueueLimit is how much data a bulk stream may have queued while
+	// interactive streams are active, so that interactive data does not
+	// queue up behind it.
+	bulkQueueLimit = 32 << 10
+	// interactiveHold is how long interactive streams count as active after
+	// they sent data.
+	interactiveHold = time.Second
+	// bulkPollInterval is how often a held back bulk stream checks whether
+	// it may go on.
+	bulkPollInterval = 5 * time.Millisecond
+)
+
+// Scheduler schedules the streams of one peer connection, holding bulk
+// streams back while interactive streams are active. SCTP sends the data of
+// all channels from one queue, so interactive data would otherwise wait for
+// all bulk data queued before it.
+type Scheduler struct {
+	mu                sync.Mutex
+	interactiveActive time.Time
+}
+
+// NewScheduler returns a scheduler for the streams of a peer connection.
+func NewScheduler() *Scheduler {
+	return &Scheduler{}
+}
+
+func (s *Scheduler) markInteractive() {
+	s.mu.Lock()
+	s.interactiveActive = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) interactive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.interactiveActive) < interactiveHold
+}
+
+// Shaper applies bandwidth limits and a priority to a bridge. The zero value
+// and nil do neither.
+type Shaper struct {
+	// Upload limits the data sent to the remote side, Download the data
+	// received from it.
+	Upload, Download *Limiter
+	// Scheduler schedules the streams of the peer connection the bridge
+	// belongs to.
+	Scheduler *Scheduler
+	// Priority is the class of the stream, PriorityAuto when empty.
+	Priority Priority
+}
+
+func (s *Shaper) upload() *Limiter {
+	if s == nil {
+		return nil
+	}
+	return s.Upload
+}
+
+func (s *Shaper) download() *Limiter {
+	if s == nil {
+		return nil
+	}
+	return s.Download
+}
+
+// schedule is called after a stream sent data over ch, sent bytes in total.
+// It holds a bulk stream back while interactive streams are active.
+func (s *Shaper) schedule(ch MessageChannel, sent int, done <-chan struct{}) {
+	if s == nil || s.Scheduler == nil {
+		return
+	}
+
+	bulk := s.Priority == PriorityBulk || (s.Priority != PriorityInteractive && sent >= autoBulkThreshold)
+	if !bulk {
+		s.Scheduler.markInteractive()
+		return
+	}
+	for ch.queued() > bulkQueueLimit && s.Scheduler.interactive() {
+		select {
+		case <-time.After(bulkPollInterval):
+		case <-done:
+			return
+		}
+	}
+}
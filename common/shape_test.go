@@ -0,0 +1,147 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateUnmarshalText(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    Rate
+		wantErr bool
+	}{
+		{text: "0", want: 0},
+		{text: "1200", want: 1200},
+		{text: "500K", want: 500_000},
+		{text: "1.5Mi", want: 1_572_864},
+		{text: "2G", want: 2_000_000_000},
+		{text: "1GiB", want: 1 << 30},
+		{text: "10MB/s", want: 10_000_000},
+		{text: "64KiB/s", want: 64 << 10},
+		{text: "", wantErr: true},
+		{text: "fast", wantErr: true},
+		{text: "1T", wantErr: true},
+		{text: "-1K", wantErr: true},
+		{text: "NaN", wantErr: true},
+		{text: "Inf", wantErr: true},
+		{text: "-InfK", wantErr: true},
+		{text: "1e300G", wantErr: true},
+		{text: "9223372036854775807", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			var r Rate
+			err := r.UnmarshalText([]byte(tt.text))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, r)
+		})
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	require.Nil(t, NewLimiter(0))
+	var none *Limiter
+	require.True(t, none.Allow(1<<30))
+
+	// The burst is a full message at this rate, which refills it in a
+	// second. The sizes leave some slack for the time the test takes.
+	const rate = 16 << 10
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		n       int
+		want    bool
+	}{
+		{name: "full bucket", n: rate, want: true},
+		{name: "empty bucket", n: 1, want: false},
+		{name: "half refilled, too much", elapsed: time.Second / 2, n: rate/2 + 1024, want: false},
+		{name: "half refilled", n: rate/2 - 1024, want: true},
+		{name: "datagram larger than the burst", elapsed: time.Hour, n: 4 * rate, want: true},
+		// Refilling is capped at the burst, so the datagram left a debt.
+		{name: "in debt", elapsed: time.Second, n: 1, want: false},
+		{name: "debt paid off", elapsed: 4 * time.Second, n: 1024, want: true},
+	}
+
+	l := NewLimiter(rate)
+	for _, tt := range tests {
+		l.last = l.last.Add(-tt.elapsed)
+		require.Equal(t, tt.want, l.Allow(tt.n), tt.name)
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	const rate = 1 << 20
+	l := NewLimiter(rate)
+
+	// The burst passes at once, and what comes after waits for the rate.
+	start := time.Now()
+	require.True(t, l.Wait(rate/4, nil))
+	require.Less(t, time.Since(start), 50*time.Millisecond)
+	require.True(t, l.Wait(rate/8, nil))
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	done := make(chan struct{})
+	close(done)
+	require.False(t, l.Wait(rate, done))
+}
+
+// queuedChannel is a channel with n bytes queued on it.
+type queuedChannel struct {
+	MessageChannel
+	n uint64
+}
+
+func (c queuedChannel) queued() uint64 { return c.n }
+
+func TestShaperSchedule(t *testing.T) {
+	full := queuedChannel{n: bulkQueueLimit + 1}
+	scheduler := NewScheduler()
+	interactive := &Shaper{Scheduler: scheduler, Priority: PriorityInteractive}
+	bulk := &Shaper{Scheduler: scheduler, Priority: PriorityBulk}
+	auto := &Shaper{Scheduler: scheduler}
+
+	// Without interactive streams, bulk streams go on.
+	scheduled := func(s *Shaper, ch MessageChannel, sent int) bool {
+		done := make(chan struct{})
+		returned := make(chan struct{})
+		go func() {
+			s.schedule(ch, sent, done)
+			close(returned)
+		}()
+		select {
+		case <-returned:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			close(done)
+			<-returned
+			return false
+		}
+	}
+	require.True(t, scheduled(bulk, full, 0))
+
+	// An auto stream counts as interactive until it sent enough, and holds
+	// back bulk streams with a full queue.
+	require.True(t, scheduled(auto, full, autoBulkThreshold-1))
+	require.False(t, scheduled(bulk, full, 0))
+	require.False(t, scheduled(auto, full, autoBulkThreshold))
+	require.True(t, scheduled(bulk, queuedChannel{n: bulkQueueLimit}, 0))
+
+	// Interactive streams are never held back.
+	require.True(t, scheduled(interactive, full, autoBulkThreshold))
+
+	// Bulk streams go on once interactive streams are idle.
+	scheduler.mu.Lock()
+	scheduler.interactiveActive = time.Now().Add(-interactiveHold)
+	scheduler.mu.Unlock()
+	require.True(t, scheduled(bulk, full, 0))
+
+	var none *Shaper
+	require.True(t, scheduled(none, full, 0))
+}
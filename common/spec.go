@@ -0,0 +1,108 @@
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// ChannelSpec describes how the data of a channel is to be handled. The
+// opening side sends it as the sub-protocol of the data channel, so that
+// both sides agree on it without another round trip.
+type ChannelSpec struct {
+	// Codec compresses the data of a stream channel. Empty means CodecNone.
+	Codec Codec
+	// Priority is the scheduling class of a stream. Empty means
+	// PriorityAuto.
+	Priority Priority
+	// Target, when set, is the address the host dials for this channel
+	// instead of its local service, over Network. It is subject to the
+	// allow-list of the host.
+	Target  string
+	Network NetProtocol
+	// Service, when set, names the service of the host this channel is
+	// bridged to instead of its default local service.
+	Service string
+	// Listen, when set, is the address a client asks the host to listen on
+	// for a remote listen, and on the channels the host opens for the
+	// connections it accepts there, the address they were accepted on.
+	Listen string
+	// Group identifies the channels a stream is striped over. Stripe is the
+	// index of this channel among them and Stripes their number. Channels
+	// that are not striped have no group.
+	Group   string
+	Stripe  int
+	Stripes int
+}
+
+// Encode returns the form of s sent as the data channel protocol.
+func (s ChannelSpec) Encode() string {
+	v := url.Values{}
+	if s.Codec != "" && s.Codec != CodecNone {
+		v.Set("codec", string(s.Codec))
+	}
+	if s.Priority != "" && s.Priority != PriorityAuto {
+		v.Set("priority", string(s.Priority))
+	}
+	if s.Target != "" {
+		v.Set("target", s.Target)
+		v.Set("network", string(s.Network))
+	}
+	if s.Service != "" {
+		v.Set("service", s.Service)
+	}
+	if s.Listen != "" {
+		v.Set("listen", s.Listen)
+	}
+	if s.Group != "" {
+		v.Set("group", s.Group)
+		v.Set("stripe", strconv.Itoa(s.Stripe))
+		v.Set("stripes", strconv.Itoa(s.Stripes))
+	}
+	return v.Encode()
+}
+
+// ParseChannelSpec parses a spec sent as the data channel protocol.
+func ParseChannelSpec(protocol string) (ChannelSpec, error) {
+	v, err := url.ParseQuery(protocol)
+	if err != nil {
+		return ChannelSpec{}, fmt.Errorf("invalid channel spec %q: %w", protocol, err)
+	}
+
+	s := ChannelSpec{Codec: CodecNone}
+	if codec := v.Get("codec"); codec != "" {
+		s.Codec = Codec(codec)
+	}
+	switch p := Priority(v.Get("priority")); p {
+	case "", PriorityAuto:
+		s.Priority = PriorityAuto
+	case PriorityInteractive, PriorityBulk:
+		s.Priority = p
+	default:
+		return ChannelSpec{}, fmt.Errorf("invalid priority %q in channel spec", p)
+	}
+	if target := v.Get("target"); target != "" {
+		s.Target = target
+		switch n := NetProtocol(v.Get("network")); n {
+		case TCP, UDP:
+			s.Network = n
+		default:
+			return ChannelSpec{}, fmt.Errorf("invalid network %q in channel spec", n)
+		}
+	}
+	s.Service = v.Get("service")
+	s.Listen = v.Get("listen")
+	if group := v.Get("group"); group != "" {
+		s.Group = group
+		if s.Stripe, err = strconv.Atoi(v.Get("stripe")); err != nil {
+			return ChannelSpec{}, fmt.Errorf("invalid stripe in channel spec %q: %w", protocol, err)
+		}
+		if s.Stripes, err = strconv.Atoi(v.Get("stripes")); err != nil {
+			return ChannelSpec{}, fmt.Errorf("invalid stripes in channel spec %q: %w", protocol, err)
+		}
+		if s.Stripes < 1 || s.Stripes > MaxStripes || s.Stripe < 0 || s.Stripe >= s.Stripes {
+			return ChannelSpec{}, fmt.Errorf("invalid stripe %d of %d in channel spec", s.Stripe, s.Stripes)
+		}
+	}
+	return s, nil
+}
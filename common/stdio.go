@@ -0,0 +1,63 @@
+package common
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// BridgeStdio wires a MessageChannel with a reader and writer pair, like the
+// standard input and output of the process, as BridgeStream does with a
+// connection. EOF on r is passed on as a FIN while data keeps flowing to w,
+// and w is closed once the remote side sent a FIN.
+func BridgeStdio(ch MessageChannel, r io.ReadCloser, w io.WriteCloser, shaper *Shaper) <-chan error {
+	return BridgeStream(ch, &stdioConn{r: r, w: w}, shaper)
+}
+
+// stdioConn is a connection reading from r and writing to w.
+type stdioConn struct {
+	r io.ReadCloser
+	w io.WriteCloser
+
+	closeWrite sync.Once
+	closeRead  sync.Once
+}
+
+func (c *stdioConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *stdioConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// CloseWrite closes w, so that its reader sees the end of the stream.
+func (c *stdioConn) CloseWrite() error {
+	var err error
+	c.closeWrite.Do(func() { err = c.w.Close() })
+	return err
+}
+
+func (c *stdioConn) Close() error {
+	err := c.CloseWrite()
+	c.closeRead.Do(func() {
+		if rerr := c.r.Close(); err == nil {
+			err = rerr
+		}
+	})
+	return err
+}
+
+func (c *stdioConn) LocalAddr() net.Addr  { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr { return stdioAddr{} }
+
+func (c *stdioConn) SetDeadline(time.Time) error      { return os.ErrNoDeadline }
+func (c *stdioConn) SetReadDeadline(time.Time) error  { return os.ErrNoDeadline }
+func (c *stdioConn) SetWriteDeadline(time.Time) error { return os.ErrNoDeadline }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
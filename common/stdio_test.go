@@ -0,0 +1,39 @@
+package common
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBridgeStdioHalfClose(t *testing.T) {
+	local, remote := channelPair(t, false, ChannelSpec{})
+	bridge, service := tcpPair(t)
+	serviceErr := BridgeStream(remote, bridge, nil)
+
+	stdin, stdinW := io.Pipe()
+	stdout, stdoutW := io.Pipe()
+	stdioErr := BridgeStdio(local, stdin, stdoutW, nil)
+
+	// EOF on stdin ends the request the service sees...
+	_, err := stdinW.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, stdinW.Close())
+	got, err := io.ReadAll(service)
+	require.NoError(t, err)
+	require.Equal(t, "request", string(got))
+
+	// ...while its response still reaches stdout, which is closed once the
+	// service is done.
+	_, err = service.Write([]byte("response"))
+	require.NoError(t, err)
+	require.NoError(t, service.(*net.TCPConn).CloseWrite())
+	got, err = io.ReadAll(stdout)
+	require.NoError(t, err)
+	require.Equal(t, "response", string(got))
+
+	require.NoError(t, <-stdioErr)
+	require.NoError(t, <-serviceErr)
+}
@@ -0,0 +1,190 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// MaxStripes is the largest number of channels a stream may be striped over.
+const MaxStripes = 16
+
+// seqSize is the size of the sequence number in front of striped messages.
+const seqSize = 8
+
+var errShortMessage = errors.New("striped message without sequence number")
+
+// Striped is a MessageChannel that spreads its messages over several
+// channels, since a single SCTP stream falls well short of the link capacity
+// on high-latency links, and puts them back in order on the receiving side.
+// Every message starts with its sequence number and is sent on the channel
+// with the least data queued.
+type Striped struct {
+	chs []*Channel
+
+	wmu  sync.Mutex
+	wseq uint64
+	next int
+
+	rmu     sync.Mutex
+	rcond   *sync.Cond
+	pending map[uint64][]byte
+	rseq    uint64
+	ended   int
+	err     error
+}
+
+// NewStriped stripes messages over chs, which must be open and in the same
+// order on both sides.
+func NewStriped(chs []*Channel) *Striped {
+	s := &Striped{
+		chs:     chs,
+		pending: map[uint64][]byte{},
+	}
+	s.rcond = sync.NewCond(&s.rmu)
+	for _, ch := range chs {
+		go s.receive(ch)
+	}
+	return s
+}
+
+// receive queues the messages of ch until it is closed.
+func (s *Striped) receive(ch *Channel) {
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := ch.Read(buf)
+		if err == nil && n < seqSize {
+			err = errShortMessage
+		}
+
+		s.rmu.Lock()
+		switch {
+		case err == io.EOF:
+			s.ended++
+		case err != nil:
+			if s.err == nil {
+				s.err = err
+			}
+		default:
+			seq := binary.BigEndian.Uint64(buf)
+			s.pending[seq] = append([]byte(nil), buf[seqSize:n]...)
+		}
+		s.rcond.Broadcast()
+		s.rmu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read returns the next message in sequence. It returns io.EOF once all
+// channels are closed.
+func (s *Striped) Read(p []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	for {
+		if msg, ok := s.pending[s.rseq]; ok {
+			if len(msg) > len(p) {
+				return 0, io.ErrShortBuffer
+			}
+			delete(s.pending, s.rseq)
+			s.rseq++
+			return copy(p, msg), nil
+		}
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.ended == len(s.chs) {
+			return 0, io.EOF
+		}
+		s.rcond.Wait()
+	}
+}
+
+// Write sends p as one message, blocking while the channel it went out on
+// has too much data queued.
+func (s *Striped) Write(p []byte) (int, error) {
+	ch, err := s.sendSeq(p)
+	if err != nil {
+		return 0, err
+	}
+	if err := ch.wait(); err != nil {
+		return len(p), err
+	}
+	return len(p), nil
+}
+
+func (s *Striped) send(p []byte) error {
+	_, err := s.sendSeq(p)
+	return err
+}
+
+// sendSeq numbers p and sends it on the least busy channel, which it
+// returns.
+func (s *Striped) sendSeq(p []byte) (*Channel, error) {
+	msg := make([]byte, seqSize+len(p))
+	copy(msg[seqSize:], p)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	// Messages are numbered and sent under the lock, so that every channel
+	// carries its messages in sequence.
+	binary.BigEndian.PutUint64(msg, s.wseq)
+	ch := s.chs[s.next]
+	for i := 1; i < len(s.chs); i++ {
+		if c := s.chs[(s.next+i)%len(s.chs)]; c.queued() < ch.queued() {
+			ch = c
+		}
+	}
+	s.next = (s.next + 1) % len(s.chs)
+	if err := ch.send(msg); err != nil {
+		return nil, err
+	}
+	s.wseq++
+	return ch, nil
+}
+
+// window lets a striped stream keep every channel busy.
+func (s *Striped) window() int {
+	return streamWindow * len(s.chs)
+}
+
+func (s *Striped) queued() uint64 {
+	var n uint64
+	for _, ch := range s.chs {
+		n += ch.queued()
+	}
+	return n
+}
+
+// Label returns the label of the first channel.
+func (s *Striped) Label() string {
+	return s.chs[0].Label()
+}
+
+// Spec returns the spec of the first channel.
+func (s *Striped) Spec() (ChannelSpec, error) {
+	return s.chs[0].Spec()
+}
+
+// Flush flushes every channel.
+func (s *Striped) Flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, ch := range s.chs {
+		ch.Flush(time.Until(deadline))
+	}
+}
+
+// Close closes every channel.
+func (s *Striped) Close() error {
+	var errs []error
+	for _, ch := range s.chs {
+		errs = append(errs, ch.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -1,12 +1,28 @@
 package common
 
+import (
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
 type NetProtocol string
 
 const (
 	TCP NetProtocol = "tcp"
 	UDP NetProtocol = "udp"
+	// Unix and Unixgram are unix domain sockets, whose addresses are paths.
+	Unix     NetProtocol = "unix"
+	Unixgram NetProtocol = "unixgram"
 )
 
+// Stream reports whether p carries streams, as opposed to datagrams. Stream
+// sessions have a control channel and a data channel per connection, packet
+// sessions a single data channel.
+func (p NetProtocol) Stream() bool {
+	return p == TCP || p == Unix
+}
+
 type RTCEventType string
 
 const (
@@ -14,3 +30,45 @@ const (
 	RTCOfferType    RTCEventType = "offer"
 	RTCAnswerType   RTCEventType = "answer"
 )
+
+// PollHold is how long the signaling server holds a request for a signal
+// before answering it with no content, to be polled again.
+const PollHold = 25 * time.Second
+
+// PrivacyMode controls which ICE candidates a peer exposes in its SDP.
+type PrivacyMode string
+
+const (
+	PrivacyOff       PrivacyMode = "off"
+	PrivacyRelayOnly PrivacyMode = "relay-only"
+	PrivacyNoHost    PrivacyMode = "no-host"
+)
+
+// Codec is a compression codec for the data of stream channels.
+type Codec string
+
+const (
+	CodecNone    Codec = "none"
+	CodecDeflate Codec = "deflate"
+)
+
+// RTCSignal is the message exchanged through the signaling server. It embeds
+// the session description so that its JSON form stays compatible with a bare
+// webrtc.SessionDescription.
+type RTCSignal struct {
+	webrtc.SessionDescription
+
+	// Session identifies the peer connection the description belongs to, so
+	// that the answerer can tell an ICE restart from a new connection.
+	Session string `json:"session,omitempty"`
+	// Bond is the session the peer connection is bonded to, if it carries
+	// stripes of the streams of another one.
+	Bond string `json:"bond,omitempty"`
+	// Privacy is the privacy mode of the sender.
+	Privacy PrivacyMode `json:"privacy,omitempty"`
+	// Codecs are the compression codecs the sender accepts for streams.
+	Codecs []Codec `json:"codecs,omitempty"`
+	// PersistentCert tells that the sender keeps its DTLS certificate across
+	// connections, so that its fingerprint can be pinned.
+	PersistentCert bool `json:"persistentCert,omitempty"`
+}
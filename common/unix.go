@@ -0,0 +1,168 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DefaultSocketMode is the default permission of the unix sockets wtt
+// creates, which only lets their owner connect.
+const DefaultSocketMode os.FileMode = 0o600
+
+// Listen listens for stream connections on addr, a path for unix sockets.
+// A stale unix socket left behind at the path is removed first, and the new
+// one gets mode.
+func Listen(network NetProtocol, addr string, mode os.FileMode) (net.Listener, error) {
+	if network != Unix {
+		return net.Listen(string(network), addr)
+	}
+	if err := removeStaleSocket(network, addr); err != nil {
+		return nil, err
+	}
+
+	dir, err := privateDir(filepath.Dir(addr))
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "s"), Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket moves to addr, which the listener removes instead.
+	l.SetUnlinkOnClose(false)
+	if err := publishSocket(l.Addr().String(), addr, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, addr: &net.UnixAddr{Name: addr, Net: "unix"}}, nil
+}
+
+// ListenPacket listens for datagrams on addr, a path for unix sockets. A
+// stale unix socket left behind at the path is removed first, the new one
+// gets mode and is removed again when the returned connection is closed.
+func ListenPacket(network NetProtocol, addr string, mode os.FileMode) (net.PacketConn, error) {
+	if network != Unixgram {
+		return net.ListenPacket(string(network), addr)
+	}
+	if err := removeStaleSocket(network, addr); err != nil {
+		return nil, err
+	}
+
+	dir, err := privateDir(filepath.Dir(addr))
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	// Datagrams sent from the socket still carry the name it was bound to,
+	// which only matters to services replying to a socket they did not
+	// connect to.
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "s"), Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	if err := publishSocket(conn.LocalAddr().String(), addr, mode); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &unixgramConn{UnixConn: conn, path: addr}, nil
+}
+
+// DialUnixgram dials the unixgram socket at addr from a socket of its own in
+// the temporary directory, so that the service can reply. The own socket gets
+// mode and is removed when the connection is closed.
+func DialUnixgram(addr string, mode os.FileMode) (net.Conn, error) {
+	dir, err := privateDir("")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "s")
+	conn, err := net.DialUnix("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"}, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err == nil {
+		err = os.Chmod(path, mode.Perm())
+	}
+	if err == nil {
+		// The service needs to reach the socket to reply, which mode still
+		// controls.
+		err = os.Chmod(dir, 0o711)
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &unixgramConn{UnixConn: conn, path: dir}, nil
+}
+
+// privateDir creates a directory in dir, the temporary directory when empty,
+// that only the owner can enter. Sockets are bound in there, where no one else
+// can connect to them before they have their mode.
+func privateDir(dir string) (string, error) {
+	return os.MkdirTemp(dir, ".wtt-")
+}
+
+// publishSocket gives the socket at tmp mode and moves it to path. Unlike a
+// rename, it fails when something exists at path already.
+func publishSocket(tmp, path string, mode os.FileMode) error {
+	if err := os.Chmod(tmp, mode.Perm()); err != nil {
+		return err
+	}
+	if err := os.Link(tmp, path); err != nil {
+		return err
+	}
+	return os.Remove(tmp)
+}
+
+// removeStaleSocket removes the unix socket at path if no one listens on it
+// anymore. Anything else at path is left alone, so that listening fails.
+func removeStaleSocket(network NetProtocol, path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.Dial(string(network), path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// unixListener is a unix socket listener at addr, which it removes when it is
+// closed.
+type unixListener struct {
+	*net.UnixListener
+	addr *net.UnixAddr
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.addr.Name)
+	return err
+}
+
+// unixgramConn is a unixgram socket at path, or in the directory path, which
+// it removes when it is closed.
+type unixgramConn struct {
+	*net.UnixConn
+	path string
+}
+
+func (c *unixgramConn) Close() error {
+	err := c.UnixConn.Close()
+	os.RemoveAll(c.path)
+	return err
+}
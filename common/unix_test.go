@@ -0,0 +1,94 @@
+package common
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenSocketMode(t *testing.T) {
+	for _, mode := range []os.FileMode{DefaultSocketMode, 0o660} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+
+			path := filepath.Join(dir, "stream.sock")
+			l, err := Listen(Unix, path, mode)
+			require.NoError(t, err)
+			requireSocket(t, path, mode)
+			require.Equal(t, path, l.Addr().String())
+			conn, err := net.Dial("unix", path)
+			require.NoError(t, err)
+			conn.Close()
+
+			packetPath := filepath.Join(dir, "packet.sock")
+			pconn, err := ListenPacket(Unixgram, packetPath, mode)
+			require.NoError(t, err)
+			requireSocket(t, packetPath, mode)
+
+			// The service sees the mode of the socket dialing it too, and can
+			// reply to it.
+			dconn, err := DialUnixgram(packetPath, mode)
+			require.NoError(t, err)
+			requireSocket(t, dconn.LocalAddr().String(), mode)
+			_, err = dconn.Write([]byte("ping"))
+			require.NoError(t, err)
+			buf := make([]byte, 16)
+			n, from, err := pconn.ReadFrom(buf)
+			require.NoError(t, err)
+			require.Equal(t, "ping", string(buf[:n]))
+			_, err = pconn.WriteTo([]byte("pong"), from)
+			require.NoError(t, err)
+			n, err = dconn.Read(buf)
+			require.NoError(t, err)
+			require.Equal(t, "pong", string(buf[:n]))
+
+			// Closing removes every socket, and leaves nothing else behind.
+			require.NoError(t, dconn.Close())
+			require.NoError(t, pconn.Close())
+			require.NoError(t, l.Close())
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Empty(t, entries)
+			require.NoFileExists(t, dconn.LocalAddr().String())
+		})
+	}
+}
+
+// requireSocket requires a unix socket with mode at path.
+func requireSocket(t *testing.T, path string, mode os.FileMode) {
+	t.Helper()
+	fi, err := os.Lstat(path)
+	require.NoError(t, err)
+	require.NotZero(t, fi.Mode()&os.ModeSocket, "%s is not a socket", path)
+	require.Equal(t, mode, fi.Mode().Perm())
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// A socket no one listens on anymore is replaced.
+	path := filepath.Join(dir, "stale.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	l, err := Listen(Unix, path, DefaultSocketMode)
+	require.NoError(t, err)
+
+	// A socket in use is not.
+	_, err = Listen(Unix, path, DefaultSocketMode)
+	require.ErrorContains(t, err, "in use")
+	require.NoError(t, l.Close())
+
+	// Neither is anything else.
+	path = filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0o600))
+	_, err = Listen(Unix, path, DefaultSocketMode)
+	require.Error(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+}
@@ -1,16 +1,24 @@
 package e2e
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"sync"
 	"testing"
 	"time"
 	"wtt/client"
 	"wtt/common"
+	"wtt/common/rtc"
 	"wtt/host"
 	"wtt/server"
 
@@ -30,6 +38,8 @@ func getFreePort(t *testing.T) int {
 }
 
 // echoServer is a simple TCP server that echoes back any data it receives.
+// It is stopped, with its connections closed, when the test ends, so that it
+// does not log after the test completed.
 func echoServer(t *testing.T, listenAddr string) net.Listener {
 	t.Helper()
 
@@ -38,15 +48,40 @@ func echoServer(t *testing.T, listenAddr string) net.Listener {
 
 	t.Logf("echo server listening on %s", l.Addr().String())
 
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	conns := map[net.Conn]struct{}{}
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		for c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		for {
 			conn, err := l.Accept()
 			if err != nil {
 				t.Logf("echo server accept loop error: %v", err)
 				return
 			}
+			mu.Lock()
+			conns[conn] = struct{}{}
+			mu.Unlock()
+			wg.Add(1)
 			go func(c net.Conn) {
-				defer c.Close()
+				defer wg.Done()
+				defer func() {
+					mu.Lock()
+					delete(conns, c)
+					mu.Unlock()
+					c.Close()
+				}()
 				c.SetDeadline(time.Now().Add(5 * time.Second))
 				// Use io.Copy to echo data.
 				// The error is logged but doesn't fail the test, as network connections can be flaky during cleanup.
@@ -90,13 +125,13 @@ func TestE2ETCP(t *testing.T) {
 
 	// 3. Start the host
 	hostID := "test-host-tcp"
-	hostErrCh := host.Run(ctx, hostID, signalURL, echoAddr, common.TCP)
+	hostErrCh := host.Run(ctx, hostID, signalURL, echoAddr, common.TCP, host.Options{})
 	t.Logf("host started, forwarding to %s", echoAddr)
 
 	// 4. Start the client
 	clientFwdPort := getFreePort(t)
 	clientFwdAddr := fmt.Sprintf("127.0.0.1:%d", clientFwdPort)
-	clientErrCh := client.Run(ctx, signalURL, hostID, clientFwdAddr, common.TCP)
+	clientErrCh := client.Run(ctx, signalURL, hostID, clientFwdAddr, common.TCP, client.Options{})
 	t.Logf("client started, forwarding from %s", clientFwdAddr)
 
 	// 5. Poll until we can connect to the client's forwarded port.
@@ -148,3 +183,823 @@ func TestE2ETCP(t *testing.T) {
 		}
 	}
 }
+
+// dnsServer is a UDP server that answers every query, a 2-byte ID followed by
+// a question, with the same ID followed by an answer to the question.
+func dnsServer(t *testing.T, listenAddr string) net.PacketConn {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", listenAddr)
+	require.NoError(t, err, "failed to start dns server")
+
+	t.Logf("dns server listening on %s", pc.LocalAddr().String())
+
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		pc.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Logf("dns server read loop error: %v", err)
+				return
+			}
+			if n < 2 {
+				continue
+			}
+			resp := append([]byte{}, buf[:2]...)
+			resp = append(resp, "answer:"...)
+			resp = append(resp, buf[2:n]...)
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				t.Logf("dns server write error: %v", err)
+			}
+		}
+	}()
+
+	return pc
+}
+
+// TestE2ETCPConcurrent runs several connections over one session at once,
+// one of which closes while the others go on.
+func TestE2ETCPConcurrent(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	echoAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	echoLn := echoServer(t, echoAddr)
+	defer echoLn.Close()
+
+	signalAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	signalURL := fmt.Sprintf("http://%s", signalAddr)
+	serverErrCh := server.Run(ctx, signalAddr, nil, 1024*1024)
+	time.Sleep(100 * time.Millisecond)
+
+	hostID := "test-host-tcp-concurrent"
+	hostErrCh := host.Run(ctx, hostID, signalURL, echoAddr, common.TCP, host.Options{})
+
+	clientFwdAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	clientErrCh := client.Run(ctx, signalURL, hostID, clientFwdAddr, common.TCP, client.Options{})
+
+	const streams = 6
+	conns := make([]net.Conn, streams)
+	require.Eventually(t, func() bool {
+		conn, err := net.DialTimeout("tcp", clientFwdAddr, time.Second)
+		conns[0] = conn
+		return err == nil
+	}, 10*time.Second, 200*time.Millisecond, "client forward port never opened")
+	for i := 1; i < streams; i++ {
+		conn, err := net.Dial("tcp", clientFwdAddr)
+		require.NoError(t, err)
+		conns[i] = conn
+	}
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+
+	// The first connection echoes a message and closes, while the others
+	// are halfway through their data.
+	var halfway sync.WaitGroup
+	halfway.Add(streams - 1)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		halfway.Wait()
+		conn := conns[0]
+		conn.Write([]byte("short-lived"))
+		buf := make([]byte, len("short-lived"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "short-lived" {
+			t.Errorf("short-lived connection echoed %q: %v", buf, err)
+		}
+		conn.Close()
+	}()
+
+	// Every other connection streams data of its own, which must come back
+	// unchanged and not mixed up with the data of the others.
+	var writers, readers sync.WaitGroup
+	writers.Add(streams - 1)
+	for i := 1; i < streams; i++ {
+		data := make([]byte, 256<<10)
+		for j := range data {
+			data[j] = byte(i*31 + j/7)
+		}
+		conn := conns[i]
+		go func() {
+			defer writers.Done()
+			half := len(data) / 2
+			conn.Write(data[:half])
+			halfway.Done()
+			<-closed
+			conn.Write(data[half:])
+			conn.(*net.TCPConn).CloseWrite()
+		}()
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Errorf("stream %d: %v", i, err)
+				return
+			}
+			if !bytes.Equal(data, got) {
+				t.Errorf("stream %d: echoed %d bytes that differ from the %d sent", i, len(got), len(data))
+			}
+		}()
+	}
+	writers.Wait()
+	readers.Wait()
+
+	cancel()
+	for range 3 {
+		select {
+		case err := <-serverErrCh:
+			require.NoError(t, err, "server exited with error")
+		case err := <-hostErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "host exited with error")
+			}
+		case err := <-clientErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "client exited with error")
+			}
+		case <-time.After(2 * time.Second):
+			t.Log("a component did not shut down in time")
+		}
+	}
+}
+
+func TestE2EUDP(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// 1. Start the DNS-style server on a random port.
+	dnsAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	dnsConn := dnsServer(t, dnsAddr)
+	defer dnsConn.Close()
+
+	// 2. Start the signaling server.
+	signalAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	signalURL := fmt.Sprintf("http://%s", signalAddr)
+	serverErrCh := server.Run(ctx, signalAddr, nil, 1024*1024)
+	time.Sleep(100 * time.Millisecond)
+
+	// 3. Start the host and the client.
+	hostID := "test-host-udp"
+	hostErrCh := host.Run(ctx, hostID, signalURL, dnsAddr, common.UDP, host.Options{})
+
+	clientFwdAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	clientErrCh := client.Run(ctx, signalURL, hostID, clientFwdAddr, common.UDP, client.Options{})
+
+	// 4. Query from two sockets at once, like a resolver using random source
+	// ports; every answer has to reach the socket that asked.
+	query := func(conn net.Conn, id byte, question string) (string, error) {
+		if _, err := conn.Write(append([]byte{0, id}, question...)); err != nil {
+			return "", err
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		if n < 2 || buf[1] != id {
+			return "", fmt.Errorf("unexpected response %q", buf[:n])
+		}
+		return string(buf[2:n]), nil
+	}
+
+	var conns []net.Conn
+	for range 2 {
+		conn, err := net.Dial("udp", clientFwdAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	// The client only forwards once the tunnel is up, retry until then.
+	require.Eventually(t, func() bool {
+		answer, err := query(conns[0], 1, "example.com")
+		return err == nil && answer == "answer:example.com"
+	}, 10*time.Second, 100*time.Millisecond, "no answer through the tunnel")
+
+	for i, conn := range conns {
+		question := fmt.Sprintf("host%d.example.com", i)
+		answer, err := query(conn, byte(10+i), question)
+		require.NoError(t, err, "failed to query through the tunnel")
+		require.Equal(t, "answer:"+question, answer)
+	}
+
+	// 5. Shut down.
+	cancel()
+
+	for range 3 {
+		select {
+		case err := <-serverErrCh:
+			require.NoError(t, err, "server exited with error")
+		case err := <-hostErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "host exited with error")
+			}
+		case err := <-clientErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "client exited with error")
+			}
+		case <-time.After(2 * time.Second):
+			t.Log("a component did not shut down in time")
+		}
+	}
+}
+
+// socksRequest negotiates with the SOCKS5 server conn and sends it a request
+// with command cmd for the IPv4 address addr. It returns the reply code and
+// the bound address.
+func socksRequest(conn net.Conn, cmd byte, addr *net.UDPAddr) (byte, *net.UDPAddr, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return 0, nil, err
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return 0, nil, err
+	}
+	if method[1] != 0 {
+		return 0, nil, fmt.Errorf("unexpected method %d", method[1])
+	}
+
+	req := append([]byte{5, cmd, 0, 1}, addr.IP.To4()...)
+	req = append(req, byte(addr.Port>>8), byte(addr.Port))
+	if _, err := conn.Write(req); err != nil {
+		return 0, nil, err
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, nil, err
+	}
+	bnd := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+	return reply[1], bnd, nil
+}
+
+// socksQueryUDP queries the DNS-style server at dnsAddr through a UDP
+// association of the SOCKS server at socksAddr.
+func socksQueryUDP(t *testing.T, socksAddr, dnsAddr string) {
+	t.Helper()
+	assoc, err := net.Dial("tcp", socksAddr)
+	require.NoError(t, err)
+	defer assoc.Close()
+	rep, relay, err := socksRequest(assoc, 3, &net.UDPAddr{IP: net.IPv4zero})
+	require.NoError(t, err)
+	require.Equal(t, byte(0), rep, "UDP ASSOCIATE failed")
+
+	udp, err := net.DialUDP("udp", nil, relay)
+	require.NoError(t, err)
+	defer udp.Close()
+	dns, _ := net.ResolveUDPAddr("udp", dnsAddr)
+	header := append([]byte{0, 0, 0, 1}, dns.IP.To4()...)
+	header = append(header, byte(dns.Port>>8), byte(dns.Port))
+	buf := make([]byte, 1024)
+	require.Eventually(t, func() bool {
+		if _, err := udp.Write(append(append([]byte{}, header...), 0, 7, 'q')); err != nil {
+			return false
+		}
+		udp.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := udp.Read(buf)
+		return err == nil && n > len(header) && string(buf[:len(header)]) == string(header) &&
+			string(buf[len(header):n]) == "\x00\x07answer:q"
+	}, 10*time.Second, 100*time.Millisecond, "no answer through the UDP association")
+}
+
+func TestE2ESOCKS(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// 1. Start the destinations: an echo server and a DNS-style server the
+	// host allows, and a port it does not.
+	echoAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	echoLn := echoServer(t, echoAddr)
+	defer echoLn.Close()
+	dnsAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	dnsConn := dnsServer(t, dnsAddr)
+	defer dnsConn.Close()
+	deniedAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+
+	// 2. Start the signaling server.
+	signalAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	signalURL := fmt.Sprintf("http://%s", signalAddr)
+	serverErrCh := server.Run(ctx, signalAddr, nil, 1024*1024)
+	time.Sleep(100 * time.Millisecond)
+
+	// 3. Start the host, as a gateway only, and the client with a SOCKS
+	// server.
+	hostID := "test-host-socks"
+	hostErrCh := host.Run(ctx, hostID, signalURL, "", common.TCP, host.Options{
+		Allow: []string{echoAddr, dnsAddr},
+	})
+
+	socksAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	clientErrCh := client.Run(ctx, signalURL, hostID, "", common.TCP, client.Options{SOCKS: socksAddr})
+
+	// 4. CONNECT to the echo server.
+	var conn net.Conn
+	var err error
+	require.Eventually(t, func() bool {
+		conn, err = net.DialTimeout("tcp", socksAddr, time.Second)
+		return err == nil
+	}, 10*time.Second, 200*time.Millisecond, "SOCKS port never opened")
+	defer conn.Close()
+
+	echo, _ := net.ResolveUDPAddr("udp", echoAddr)
+	rep, _, err := socksRequest(conn, 1, echo)
+	require.NoError(t, err)
+	require.Equal(t, byte(0), rep, "CONNECT to an allowed destination failed")
+
+	message := "hello socks"
+	_, err = conn.Write([]byte(message))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.ReadAtLeast(conn, buf, len(message))
+	require.NoError(t, err, "failed to read echoed message")
+	require.Equal(t, message, string(buf[:n]))
+
+	// 5. CONNECT to a destination the host does not allow.
+	denied, err := net.Dial("tcp", socksAddr)
+	require.NoError(t, err)
+	defer denied.Close()
+	deniedUDPAddr, _ := net.ResolveUDPAddr("udp", deniedAddr)
+	rep, _, err = socksRequest(denied, 1, deniedUDPAddr)
+	require.NoError(t, err)
+	require.Equal(t, byte(2), rep, "CONNECT to a destination outside the allow-list was not refused as not allowed")
+
+	// CONNECT to an allowed destination with nothing listening over TCP.
+	refused, err := net.Dial("tcp", socksAddr)
+	require.NoError(t, err)
+	defer refused.Close()
+	dnsTCPAddr, _ := net.ResolveUDPAddr("udp", dnsAddr)
+	rep, _, err = socksRequest(refused, 1, dnsTCPAddr)
+	require.NoError(t, err)
+	require.Equal(t, byte(5), rep, "CONNECT to a closed port was not refused as connection refused")
+
+	// 6. Query the DNS-style server through a UDP association.
+	socksQueryUDP(t, socksAddr, dnsAddr)
+
+	// 7. Shut down.
+	cancel()
+
+	for range 3 {
+		select {
+		case err := <-serverErrCh:
+			require.NoError(t, err, "server exited with error")
+		case err := <-hostErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "host exited with error")
+			}
+		case err := <-clientErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "client exited with error")
+			}
+		case <-time.After(2 * time.Second):
+			t.Log("a component did not shut down in time")
+		}
+	}
+}
+
+// TestE2ESOCKSReliableUDP relays a UDP association over reliable data
+// channels.
+func TestE2ESOCKSReliableUDP(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	dnsAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	dnsConn := dnsServer(t, dnsAddr)
+	defer dnsConn.Close()
+
+	signalAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	signalURL := fmt.Sprintf("http://%s", signalAddr)
+	serverErrCh := server.Run(ctx, signalAddr, nil, 1024*1024)
+	time.Sleep(100 * time.Millisecond)
+
+	hostID := "test-host-socks-reliable"
+	hostErrCh := host.Run(ctx, hostID, signalURL, "", common.TCP, host.Options{
+		Allow: []string{dnsAddr},
+	})
+
+	socksAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	clientErrCh := client.Run(ctx, signalURL, hostID, "", common.TCP, client.Options{
+		SOCKS:       socksAddr,
+		Reliability: rtc.Reliability{Reliable: true},
+	})
+	require.Eventually(t, func() bool {
+		conn, err := net.DialTimeout("tcp", socksAddr, time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 10*time.Second, 200*time.Millisecond, "SOCKS port never opened")
+
+	socksQueryUDP(t, socksAddr, dnsAddr)
+
+	cancel()
+	for range 3 {
+		select {
+		case err := <-serverErrCh:
+			require.NoError(t, err, "server exited with error")
+		case err := <-hostErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "host exited with error")
+			}
+		case err := <-clientErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "client exited with error")
+			}
+		case <-time.After(2 * time.Second):
+			t.Log("a component did not shut down in time")
+		}
+	}
+}
+
+func TestE2EHTTPProxy(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// 1. Start the destinations the host allows: an echo server and an
+	// HTTP server.
+	echoAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	echoLn := echoServer(t, echoAddr)
+	defer echoLn.Close()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer web.Close()
+	webAddr := web.Listener.Addr().String()
+
+	// 2. Start the signaling server.
+	signalAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	signalURL := fmt.Sprintf("http://%s", signalAddr)
+	serverErrCh := server.Run(ctx, signalAddr, nil, 1024*1024)
+	time.Sleep(100 * time.Millisecond)
+
+	// 3. Start the host and the client with an HTTP proxy.
+	hostID := "test-host-http-proxy"
+	hostErrCh := host.Run(ctx, hostID, signalURL, "", common.TCP, host.Options{
+		Allow: []string{echoAddr, webAddr},
+	})
+
+	proxyAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	clientErrCh := client.Run(ctx, signalURL, hostID, "", common.TCP, client.Options{
+		HTTPProxy: proxyAddr,
+		ProxyAuth: "user:secret",
+	})
+
+	// 4. Requests without credentials are refused.
+	require.Eventually(t, func() bool {
+		conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 10*time.Second, 200*time.Millisecond, "proxy port never opened")
+
+	noAuth := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr})}}
+	resp, err := noAuth.Get(web.URL + "/page")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	// 5. An absolute-URI request reaches the HTTP server.
+	proxyURL := &url.URL{Scheme: "http", User: url.UserPassword("user", "secret"), Host: proxyAddr}
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+	resp, err = hc.Get(web.URL + "/page")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello /page", string(body))
+
+	// 6. CONNECT tunnels to the echo server, but not to destinations
+	// outside the allow-list.
+	connect := func(target string) (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n",
+			target, target, base64.StdEncoding.EncodeToString([]byte("user:secret")))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		return conn, resp
+	}
+
+	conn, resp := connect(echoAddr)
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	message := "hello proxy"
+	_, err = conn.Write([]byte(message))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	n, err := io.ReadAtLeast(conn, buf, len(message))
+	require.NoError(t, err, "failed to read echoed message")
+	require.Equal(t, message, string(buf[:n]))
+
+	denied, resp := connect(fmt.Sprintf("127.0.0.1:%d", getFreePort(t)))
+	defer denied.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// 7. Shut down.
+	cancel()
+
+	for range 3 {
+		select {
+		case err := <-serverErrCh:
+			require.NoError(t, err, "server exited with error")
+		case err := <-hostErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "host exited with error")
+			}
+		case err := <-clientErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "client exited with error")
+			}
+		case <-time.After(2 * time.Second):
+			t.Log("a component did not shut down in time")
+		}
+	}
+}
+
+func TestE2EForwards(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// 1. Start the services of the host: an echo server as its default
+	// service and an HTTP server as a named one.
+	echoAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	echoLn := echoServer(t, echoAddr)
+	defer echoLn.Close()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello web")
+	}))
+	defer web.Close()
+
+	// 2. Start the signaling server.
+	signalAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	signalURL := fmt.Sprintf("http://%s", signalAddr)
+	serverErrCh := server.Run(ctx, signalAddr, nil, 1024*1024)
+	time.Sleep(100 * time.Millisecond)
+
+	// 3. Start the host and a client with a forward to each service, and one
+	// whose address is taken, which must not take the others down.
+	hostID := "test-host-forwards"
+	hostErrCh := host.Run(ctx, hostID, signalURL, echoAddr, common.TCP, host.Options{
+		Services: map[string]string{"web": web.Listener.Addr().String()},
+	})
+
+	echoFwdAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	webFwdAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	clientErrCh := client.Run(ctx, signalURL, "", "", common.TCP, client.Options{
+		Forwards: []client.Forward{
+			{Local: echoFwdAddr, Host: hostID},
+			{Local: webFwdAddr, Host: hostID, Service: "web"},
+			{Local: signalAddr, Host: hostID},
+		},
+	})
+
+	// 4. Both forwards reach their service.
+	var conn net.Conn
+	var err error
+	require.Eventually(t, func() bool {
+		conn, err = net.DialTimeout("tcp", echoFwdAddr, time.Second)
+		return err == nil
+	}, 10*time.Second, 200*time.Millisecond, "echo forward never opened")
+	defer conn.Close()
+
+	message := "hello forwards"
+	_, err = conn.Write([]byte(message))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.ReadAtLeast(conn, buf, len(message))
+	require.NoError(t, err, "failed to read echoed message")
+	require.Equal(t, message, string(buf[:n]))
+
+	// Every forward listens once its own session connected.
+	require.Eventually(t, func() bool {
+		c, err := net.DialTimeout("tcp", webFwdAddr, time.Second)
+		if err == nil {
+			c.Close()
+		}
+		return err == nil
+	}, 10*time.Second, 200*time.Millisecond, "web forward never opened")
+	hc := &http.Client{Timeout: 5 * time.Second}
+	resp, err := hc.Get("http://" + webFwdAddr + "/")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "hello web", string(body))
+
+	// 5. Shut down.
+	cancel()
+
+	for range 3 {
+		select {
+		case err := <-serverErrCh:
+			require.NoError(t, err, "server exited with error")
+		case err := <-hostErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "host exited with error")
+			}
+		case err := <-clientErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "client exited with error")
+			}
+		case <-time.After(2 * time.Second):
+			t.Log("a component did not shut down in time")
+		}
+	}
+}
+
+func TestE2ERemoteListen(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// 1. Start the echo server on the client side.
+	echoAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	echoLn := echoServer(t, echoAddr)
+	defer echoLn.Close()
+
+	// 2. Start the signaling server.
+	signalAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	signalURL := fmt.Sprintf("http://%s", signalAddr)
+	serverErrCh := server.Run(ctx, signalAddr, nil, 1024*1024)
+	time.Sleep(100 * time.Millisecond)
+
+	// 3. Start a host allowing one listen address, and a client asking it to
+	// listen there.
+	hostID := "test-host-remote-listen"
+	remoteAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	hostErrCh := host.Run(ctx, hostID, signalURL, "", common.TCP, host.Options{
+		AllowListen: []string{remoteAddr},
+	})
+	clientErrCh := client.Run(ctx, signalURL, hostID, "", common.TCP, client.Options{
+		RemoteListens: []client.RemoteListen{{Remote: remoteAddr, Local: echoAddr}},
+	})
+
+	// 4. Connections to the remote address reach the echo server.
+	var conn net.Conn
+	var err error
+	require.Eventually(t, func() bool {
+		conn, err = net.DialTimeout("tcp", remoteAddr, time.Second)
+		return err == nil
+	}, 10*time.Second, 200*time.Millisecond, "remote listen never opened")
+	defer conn.Close()
+
+	message := "hello remote listen"
+	_, err = conn.Write([]byte(message))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.ReadAtLeast(conn, buf, len(message))
+	require.NoError(t, err, "failed to read echoed message")
+	require.Equal(t, message, string(buf[:n]))
+
+	// 5. A listen on an address the host does not allow is refused.
+	deniedErrCh := client.Run(ctx, signalURL, hostID, "", common.TCP, client.Options{
+		RemoteListens: []client.RemoteListen{{Remote: fmt.Sprintf("127.0.0.1:%d", getFreePort(t)), Local: echoAddr}},
+	})
+	select {
+	case err := <-deniedErrCh:
+		require.ErrorContains(t, err, "not allowed")
+	case <-time.After(10 * time.Second):
+		t.Fatal("listen on an address outside the allow-list was not refused")
+	}
+
+	// 6. Shut down.
+	cancel()
+
+	for range 3 {
+		select {
+		case err := <-serverErrCh:
+			require.NoError(t, err, "server exited with error")
+		case err := <-hostErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "host exited with error")
+			}
+		case err := <-clientErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "client exited with error")
+			}
+		case <-time.After(2 * time.Second):
+			t.Log("a component did not shut down in time")
+		}
+	}
+}
+
+func TestE2ETarget(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// 1. Start the echo server the client targets.
+	echoPort := getFreePort(t)
+	echoAddr := fmt.Sprintf("127.0.0.1:%d", echoPort)
+	echoLn := echoServer(t, echoAddr)
+	defer echoLn.Close()
+
+	// 2. Start the signaling server.
+	signalAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	signalURL := fmt.Sprintf("http://%s", signalAddr)
+	serverErrCh := server.Run(ctx, signalAddr, nil, 1024*1024)
+	time.Sleep(100 * time.Millisecond)
+
+	// 3. Start a host without a local service that allows a range of ports,
+	// a client targeting the echo server within it, and one targeting a port
+	// outside of it.
+	hostID := "test-host-target"
+	hostErrCh := host.Run(ctx, hostID, signalURL, "", common.TCP, host.Options{
+		Allow: []string{fmt.Sprintf("127.0.0.0/8:%d-%d", echoPort, echoPort+1)},
+	})
+
+	clientAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	clientErrCh := client.Run(ctx, signalURL, hostID, clientAddr, common.TCP, client.Options{
+		Target: echoAddr,
+	})
+	deniedAddr := fmt.Sprintf("127.0.0.1:%d", getFreePort(t))
+	deniedErrCh := client.Run(ctx, signalURL, hostID, deniedAddr, common.TCP, client.Options{
+		Target: fmt.Sprintf("127.0.0.1:%d", echoPort+2),
+	})
+
+	// 4. The allowed target is reached.
+	var conn net.Conn
+	var err error
+	require.Eventually(t, func() bool {
+		conn, err = net.DialTimeout("tcp", clientAddr, time.Second)
+		return err == nil
+	}, 10*time.Second, 200*time.Millisecond, "client port never opened")
+	defer conn.Close()
+
+	message := "hello target"
+	_, err = conn.Write([]byte(message))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.ReadAtLeast(conn, buf, len(message))
+	require.NoError(t, err, "failed to read echoed message")
+	require.Equal(t, message, string(buf[:n]))
+
+	// 5. The target outside the allow-list is refused: the connection is
+	// closed without data.
+	var denied net.Conn
+	require.Eventually(t, func() bool {
+		denied, err = net.DialTimeout("tcp", deniedAddr, time.Second)
+		return err == nil
+	}, 10*time.Second, 200*time.Millisecond, "denied client port never opened")
+	defer denied.Close()
+	denied.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = denied.Read(buf)
+	require.ErrorIs(t, err, io.EOF, "connection to a target outside the allow-list was not closed")
+
+	// 6. Shut down.
+	cancel()
+
+	for range 4 {
+		select {
+		case err := <-serverErrCh:
+			require.NoError(t, err, "server exited with error")
+		case err := <-hostErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "host exited with error")
+			}
+		case err := <-clientErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "client exited with error")
+			}
+		case err := <-deniedErrCh:
+			if err != nil && err.Error() != "context canceled" {
+				require.NoError(t, err, "client exited with error")
+			}
+		case <-time.After(2 * time.Second):
+			t.Log("a component did not shut down in time")
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"wtt/common"
+)
+
+// errNotAllowed is the reason streams to destinations outside the allow-list
+// are rejected with.
+var errNotAllowed = fmt.Errorf("destination %w", common.ErrNotAllowed)
+
+// allowRule allows the addresses of a prefix, or the host names matching
+// name, on the ports from lo to hi.
+type allowRule struct {
+	prefix netip.Prefix
+	// name is a lowercase host name, or a domain whose subdomains match when
+	// it starts with "*.".
+	name   string
+	lo, hi uint16
+}
+
+// allowList holds the destinations clients may ask the host to dial. An
+// empty list allows none.
+type allowList []allowRule
+
+// parseAllowList parses rules of the form ADDR[:PORTS], where ADDR is an IP
+// address, a CIDR prefix or a host name, with a leading *. matching its
+// subdomains, bracketed when it is IPv6 and ports follow, and PORTS is a port
+// or a range of ports, as in 10.0.0.0/8, 192.168.1.10:22, db.internal:5432,
+// *.corp.example:8000-8099 or [fd00::/8]:443.
+func parseAllowList(rules []string) (allowList, error) {
+	var l allowList
+	for _, r := range rules {
+		addr, ports := r, ""
+		if rest, ok := strings.CutPrefix(r, "["); ok {
+			var found bool
+			if addr, ports, found = strings.Cut(rest, "]"); !found {
+				return nil, fmt.Errorf("invalid allow rule %q: missing ]", r)
+			}
+			if ports != "" {
+				if ports, found = strings.CutPrefix(ports, ":"); !found {
+					return nil, fmt.Errorf("invalid allow rule %q", r)
+				}
+			}
+		} else if strings.Count(r, ":") == 1 {
+			addr, ports, _ = strings.Cut(r, ":")
+		}
+
+		rule := allowRule{lo: 1, hi: 65535}
+		var err error
+		switch {
+		case strings.Contains(addr, "/"):
+			rule.prefix, err = netip.ParsePrefix(addr)
+			rule.prefix = rule.prefix.Masked()
+		case isHostName(addr):
+			rule.name = strings.ToLower(addr)
+		default:
+			var ip netip.Addr
+			ip, err = netip.ParseAddr(addr)
+			rule.prefix = netip.PrefixFrom(ip, ip.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow rule %q: %w", r, err)
+		}
+		if ports != "" {
+			if rule.lo, rule.hi, err = parsePorts(ports); err != nil {
+				return nil, fmt.Errorf("invalid allow rule %q: %w", r, err)
+			}
+		}
+		l = append(l, rule)
+	}
+	return l, nil
+}
+
+// isHostName reports whether s is a host name, optionally with a leading *.,
+// rather than an IP address.
+func isHostName(s string) bool {
+	s = strings.TrimPrefix(s, "*.")
+	if s == "" || strings.Trim(s, "0123456789.") == "" {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parsePorts parses a port or a range of ports of the form LO-HI.
+func parsePorts(s string) (lo, hi uint16, err error) {
+	los, his, isRange := strings.Cut(s, "-")
+	if lo, err = parsePort(los); err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return lo, lo, nil
+	}
+	if hi, err = parsePort(his); err != nil {
+		return 0, 0, err
+	}
+	if hi < lo {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	p, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || p == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(p), nil
+}
+
+func (r allowRule) allowsPort(port uint16) bool {
+	return r.lo <= port && port <= r.hi
+}
+
+func (l allowList) allows(ip netip.Addr, port uint16) bool {
+	ip = ip.Unmap()
+	for _, r := range l {
+		if r.name == "" && r.prefix.Contains(ip) && r.allowsPort(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsName reports whether a name rule allows the host name on port.
+func (l allowList) allowsName(name string, port uint16) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, r := range l {
+		if r.name == "" || !r.allowsPort(port) {
+			continue
+		}
+		rule := strings.TrimSuffix(r.name, ".")
+		if domain, ok := strings.CutPrefix(rule, "*"); ok {
+			if strings.HasSuffix(name, domain) {
+				return true
+			}
+		} else if name == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupNetIP resolves the host names of targets.
+var lookupNetIP = net.DefaultResolver.LookupNetIP
+
+// resolve resolves target, a host:port a client asked the host to dial, to
+// the first of its addresses the allow-list allows, or to its first address
+// if a rule allows its host name. The resolved address is dialed rather than
+// the name, so that the name cannot resolve differently in between.
+func (l allowList) resolve(ctx context.Context, target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	p, err := parsePort(port)
+	if err != nil {
+		return "", err
+	}
+
+	var ips []netip.Addr
+	byName := false
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else {
+		if byName = l.allowsName(host, p); !byName && !l.hasPrefixes() {
+			// Do not resolve names no rule could allow.
+			return "", errNotAllowed
+		}
+		if ips, err = lookupNetIP(ctx, "ip", host); err != nil {
+			return "", err
+		}
+	}
+	for _, ip := range ips {
+		if byName || l.allows(ip, p) {
+			return netip.AddrPortFrom(ip.Unmap(), p).String(), nil
+		}
+	}
+	return "", errNotAllowed
+}
+
+// hasPrefixes reports whether the list has rules for addresses.
+func (l allowList) hasPrefixes() bool {
+	for _, r := range l {
+		if r.name == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAllowList(t *testing.T) {
+	tests := []struct {
+		rule    string
+		wantErr bool
+	}{
+		{rule: "10.0.0.0/8"},
+		{rule: "192.168.1.10:22"},
+		{rule: "db.internal:5432"},
+		{rule: "*.corp.example:8000-8099"},
+		{rule: "[fd00::/8]:443"},
+		{rule: "fd00::1"},
+		{rule: "10.0.0.1:90-80", wantErr: true},
+		{rule: "10.0.0.1:0", wantErr: true},
+		{rule: "10.0.0.1:65536", wantErr: true},
+		{rule: "[fd00::1", wantErr: true},
+		{rule: "[fd00::1]443", wantErr: true},
+		{rule: "300.0.0.1", wantErr: true},
+		{rule: "-bad-.example", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			_, err := parseAllowList([]string{tt.rule})
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestAllowListSkipsLookup checks that names no rule could allow are not
+// even resolved.
+func TestAllowListSkipsLookup(t *testing.T) {
+	defer func(lookup func(context.Context, string, string) ([]netip.Addr, error)) { lookupNetIP = lookup }(lookupNetIP)
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		return nil, errors.New("unexpected lookup of " + host)
+	}
+
+	l, err := parseAllowList([]string{"db.internal", "*.corp.example"})
+	require.NoError(t, err)
+	_, err = l.resolve(context.Background(), "db.internal.evil.example:80")
+	require.ErrorIs(t, err, errNotAllowed)
+}
+
+func TestAllowListResolve(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []string
+		target string
+		// want is the address to dial, empty when the target is not allowed.
+		want string
+	}{
+		{name: "IP in prefix", rules: []string{"10.0.0.0/8"}, target: "10.1.2.3:80", want: "10.1.2.3:80"},
+		{name: "IP outside prefix", rules: []string{"10.0.0.0/8"}, target: "11.1.2.3:80"},
+		{name: "port in range", rules: []string{"192.168.1.10:8000-8099"}, target: "192.168.1.10:8099", want: "192.168.1.10:8099"},
+		{name: "port outside range", rules: []string{"192.168.1.10:8000-8099"}, target: "192.168.1.10:8100"},
+		{name: "bracketed v6", rules: []string{"[fd00::/8]:443"}, target: "[fd00::1]:443", want: "[fd00::1]:443"},
+		{name: "bracketed v6 other port", rules: []string{"[fd00::/8]:443"}, target: "[fd00::1]:444"},
+		{name: "v4-mapped v6", rules: []string{"10.0.0.0/8"}, target: "[::ffff:10.0.0.1]:80", want: "10.0.0.1:80"},
+
+		{name: "exact name", rules: []string{"db.internal:5432"}, target: "db.internal:5432", want: "192.0.2.1:5432"},
+		{name: "wildcard subdomain", rules: []string{"*.corp.example"}, target: "db.corp.example:80", want: "192.0.2.1:80"},
+		{name: "wildcard nested subdomain", rules: []string{"*.corp.example"}, target: "a.db.corp.example:80", want: "192.0.2.1:80"},
+		{name: "wildcard apex", rules: []string{"*.corp.example"}, target: "corp.example:80"},
+		{name: "wildcard look-alike", rules: []string{"*.corp.example"}, target: "evilcorp.example:80"},
+		{name: "exact name subdomain", rules: []string{"corp.example"}, target: "db.corp.example:80"},
+		{name: "trailing dot in target", rules: []string{"db.internal"}, target: "db.internal.:80", want: "192.0.2.1:80"},
+		{name: "trailing dot in rule", rules: []string{"db.internal."}, target: "db.internal:80", want: "192.0.2.1:80"},
+		{name: "mixed case", rules: []string{"DB.Internal", "*.Corp.Example"}, target: "db.CORP.example:80", want: "192.0.2.1:80"},
+		{name: "mixed case exact", rules: []string{"DB.Internal"}, target: "Db.INTERNAL:80", want: "192.0.2.1:80"},
+
+		{name: "name resolving to allowed IP", rules: []string{"192.0.2.0/24"}, target: "web.example:22", want: "192.0.2.1:22"},
+		{name: "name resolving to disallowed IP", rules: []string{"10.0.0.0/8"}, target: "web.example:22"},
+		{name: "name resolving to IP allowed on other port", rules: []string{"192.0.2.0/24:443"}, target: "web.example:22"},
+	}
+
+	// Every name resolves to 192.0.2.1.
+	defer func(lookup func(context.Context, string, string) ([]netip.Addr, error)) { lookupNetIP = lookup }(lookupNetIP)
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("192.0.2.1")}, nil
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := parseAllowList(tt.rules)
+			require.NoError(t, err)
+
+			got, err := l.resolve(context.Background(), tt.target)
+			if tt.want == "" {
+				require.ErrorIs(t, err, errNotAllowed)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -2,8 +2,13 @@ package host
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
+	"os"
+	"slices"
+	"strings"
 
 	"wtt/common"
 	"wtt/common/rtc"
@@ -13,132 +18,438 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
-func Run(ctx context.Context, id, signalingAddr, localAddr string, protocol common.NetProtocol) <-chan error {
-	slog.Info("host running")
+// Options holds the optional host settings.
+type Options struct {
+	// ICETCPAddress, when set, is the address on which passive ICE-TCP
+	// connections are accepted.
+	ICETCPAddress string
+	// ICE holds the STUN/TURN servers, the candidate privacy mode and the ICE
+	// restart grace period.
+	ICE rtc.ICEOptions
+	// Timeouts bounds every phase of establishing a connection. A session
+	// that misses a deadline is dropped and the host waits for the next offer.
+	Timeouts rtc.Timeouts
+	// HTTP configures the client used to reach the signaling server.
+	HTTP rtc.HTTPOptions
+	// Certificate is the path of the persistent DTLS certificate whose
+	// fingerprint clients pin. When empty a new certificate is generated for
+	// every connection.
+	Certificate string
+	// Flows limits the UDP flows, each with its own socket to the local
+	// service.
+	Flows common.FlowOptions
+	// Codecs are the compression codecs clients may use for streams.
+	Codecs []common.Codec
+	// Upload and Download limit the rate of the data sent to and received
+	// from all clients together. Zero means no limit.
+	Upload, Download common.Rate
+	// Allow lists the destinations clients may ask the host to dial, with a
+	// target or by SOCKS, in the form ADDR[:PORTS] where ADDR is an IP
+	// address, a CIDR prefix or a host name, *.domain matching its
+	// subdomains, and PORTS a port or a range of ports. None are allowed when
+	// empty.
+	Allow []string
+	// Services maps the names of the services clients may ask for to their
+	// addresses, dialed with the protocol of the host unless prefixed by
+	// another one of the same kind, as in unix:/var/run/docker.sock.
+	Services map[string]string
+	// SocketMode is the permission of the unixgram sockets the replies of a
+	// local unixgram service are received on, common.DefaultSocketMode when
+	// zero.
+	SocketMode os.FileMode
+	// AllowListen lists the addresses clients may ask the host to listen on
+	// for remote listens, whose connections are bridged back to the client.
+	// None are allowed when empty.
+	AllowListen []string
 
-	ec := make(chan error)
+	allow allowList
+}
 
-	go func() {
-		for {
-			pcCfg := webrtc.Configuration{}
-			slog.Debug("creating peer connection")
-			pc, err := answerer.A_CreatePeerConnection(pcCfg)
-			if err != nil {
-				slog.Error("create peer connection error", "err", err)
-				ec <- err
-				return
+func (o Options) socketMode() os.FileMode {
+	if o.SocketMode == 0 {
+		return common.DefaultSocketMode
+	}
+	return o.SocketMode
+}
+
+// service returns the protocol and address of the service name for a session
+// of protocol.
+func (o Options) service(protocol common.NetProtocol, name string) (common.NetProtocol, string, error) {
+	addr, ok := o.Services[name]
+	if !ok {
+		return protocol, "", fmt.Errorf("unknown service %q", name)
+	}
+	if network, rest, ok := strings.Cut(addr, ":"); ok {
+		switch n := common.NetProtocol(network); n {
+		case common.TCP, common.UDP, common.Unix, common.Unixgram:
+			if n.Stream() != protocol.Stream() {
+				return protocol, "", fmt.Errorf("service %q is not a %s service", name, protocol)
 			}
+			return n, rest, nil
+		}
+	}
+	return protocol, addr, nil
+}
 
-			dcC := make(chan *webrtc.DataChannel, 1)
-			pc.OnDataChannel(func(dc *webrtc.DataChannel) {
-				slog.Debug("data channel created", "label", dc.Label())
-				dcC <- dc
-			})
+func Run(ctx context.Context, id, signalingAddr, localAddr string, protocol common.NetProtocol, opts Options) <-chan error {
+	slog.Info("host running")
 
-			hc := resty.New().SetBaseURL(signalingAddr)
-			if err := rtc.RegisterHost(hc, id); err != nil {
-				slog.Error("register host error", "err", err)
-				ec <- err
+	ec := make(chan error)
+
+	go func() {
+		var err error
+		if opts.allow, err = parseAllowList(opts.Allow); err != nil {
+			ec <- err
+			return
+		}
+		for _, c := range opts.Codecs {
+			if c != common.CodecNone && c != common.CodecDeflate {
+				ec <- fmt.Errorf("unsupported codec %q", c)
 				return
 			}
+		}
 
-			slog.Debug("waiting for offer")
-			offer, err := rtc.ReceiveRTCEvent(hc, common.RTCOfferType, id)
+		se := webrtc.SettingEngine{}
+		if opts.ICETCPAddress != "" {
+			l, err := rtc.ListenICETCP(&se, opts.ICETCPAddress)
 			if err != nil {
-				slog.Error("receive offer error", "err", err)
+				slog.Error("listen ICE-TCP error", "err", err)
 				ec <- err
 				return
 			}
-			slog.Debug("received offer", "id", id)
+			defer l.Close()
+		}
 
-			slog.Debug("setting remote description")
-			if err := answerer.B_SetOfferAsRemoteDescription(pc, *offer); err != nil {
-				slog.Error("set remote description error", "err", err)
+		pcCfg := webrtc.Configuration{}
+		if err := opts.ICE.Configure(&pcCfg, &se); err != nil {
+			slog.Error("configure ICE error", "err", err)
+			ec <- err
+			return
+		}
+		if opts.Certificate != "" {
+			if err := rtc.UseCertificate(&pcCfg, opts.Certificate); err != nil {
+				slog.Error("load certificate error", "err", err)
 				ec <- err
 				return
 			}
+		}
 
-			answerO := webrtc.AnswerOptions{}
-			slog.Debug("creating answer")
-			answer, err := answerer.C_CreateAnswer(pc, answerO)
-			if err != nil {
-				slog.Error("create answer error", "err", err)
-				ec <- err
-				return
-			}
-			slog.Debug("setting local description")
-			if err := answerer.D_SetAnswerAsLocalDescription(pc, *answer); err != nil {
-				slog.Error("set local description error", "err", err)
-				ec <- err
-				return
-			}
+		hc, err := rtc.NewHTTPClient(signalingAddr, opts.HTTP)
+		if err != nil {
+			slog.Error("create signaling client error", "err", err)
+			ec <- err
+			return
+		}
+		if err := rtc.RegisterHost(ctx, hc, id); err != nil {
+			slog.Error("register host error", "err", err)
+			ec <- err
+			return
+		}
 
-			<-webrtc.GatheringCompletePromise(pc)
-			ld := pc.LocalDescription()
-			if ld == nil {
-				slog.Error("local description is nil after gathering")
-				ec <- webrtc.ErrConnectionClosed
-				return
-			}
+		// sessions maps the session ID of every live peer connection to it, so
+		// that ICE restart offers reach the right one.
+		sessions := common.NewRWLock(map[string]*webrtc.PeerConnection{})
+		striped := newStripes()
+		if protocol.Stream() && len(opts.Codecs) > 0 {
+			rctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go common.ReportCompression(rctx)
+		}
+		limits := common.Shaper{
+			Upload:   common.NewLimiter(opts.Upload),
+			Download: common.NewLimiter(opts.Download),
+		}
 
-			slog.Debug("sending answer")
-			if err := rtc.SendRTCEvent(hc, common.RTCAnswerType, id, *ld); err != nil {
-				slog.Error("send answer error", "err", err)
+		for {
+			slog.Debug("waiting for offer")
+			offer, err := rtc.ReceiveRTCEvent(ctx, hc, common.RTCOfferType, id, "")
+			if err != nil {
+				if ctx.Err() != nil {
+					ec <- ctx.Err()
+					return
+				}
+				if rtc.IsTimeout(err) {
+					// Waiting for an offer is a long poll, poll again.
+					slog.Debug("no offer received before the request timed out")
+					continue
+				}
+				slog.Error("receive offer error", "err", err)
 				ec <- err
 				return
 			}
+			slog.Info("received offer", "id", id, "session", offer.Session, "privacy", offer.Privacy)
 
-			slog.Debug("waiting for data channel")
-			select {
-			case dc := <-dcC:
-				opened := make(chan struct{})
-				dc.OnOpen(func() { opened <- struct{}{} })
-
-				slog.Debug("waiting for data channel to open")
-				select {
-				case <-opened:
-					slog.Info("start bridging", "protocol", protocol, "local", localAddr)
-
-					var bridgeErrCh <-chan error
-					switch protocol {
-					case common.TCP:
-						conn, err := net.Dial("tcp", localAddr)
-						if err != nil {
-							slog.Error("host failed to dial local service", "err", err)
-							pc.Close() // Close the current peer connection
-							continue   // And try to get a new one
-						}
-						bridgeErrCh = common.BridgeStream(dc, conn)
-					case common.UDP:
-						conn, err := net.ListenPacket("udp", localAddr)
-						if err != nil {
-							slog.Error("host failed to listen on local udp", "err", err)
-							pc.Close()
-							continue
-						}
-						bridgeErrCh = common.BridgePacket(dc, conn)
+			// Offers are answered concurrently, so that an ICE restart does
+			// not wait for the candidates of another session to be gathered.
+			go func(offer *common.RTCSignal) {
+				var pc *webrtc.PeerConnection
+				if offer.Session != "" {
+					sessions.Read(func(m map[string]*webrtc.PeerConnection) { pc = m[offer.Session] })
+				}
+				if pc != nil {
+					slog.Info("restarting ICE", "session", offer.Session)
+					if err := answer(ctx, hc, id, pc, *offer, opts); err != nil {
+						slog.Error("ICE restart error", "session", offer.Session, "err", err)
 					}
+					return
+				}
 
-					// Wait for the bridge to finish
-					if err := <-bridgeErrCh; err != nil {
-						slog.Error("bridge finished with error", "err", err)
-					} else {
-						slog.Debug("bridge finished cleanly")
+				slog.Debug("creating peer connection")
+				pc, err := answerer.A_CreatePeerConnection(pcCfg, se)
+				if err != nil {
+					slog.Error("create peer connection error", "err", err)
+					return
+				}
+
+				closed := rtc.MonitorICE(pc, opts.ICE.RestartGrace, nil)
+				chC := make(chan *common.Channel, 1)
+				pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+					slog.Debug("data channel created", "label", dc.Label())
+					select {
+					case chC <- common.NewChannel(dc):
+					case <-closed:
 					}
+				})
 
-				case <-ctx.Done():
-					ec <- ctx.Err()
+				if err := answer(ctx, hc, id, pc, *offer, opts); err != nil {
+					slog.Error("answer offer error", "session", offer.Session, "err", err)
+					pc.Close()
+					return
 				}
-			case <-ctx.Done():
-				ec <- ctx.Err()
-			}
 
-			// The connection is done, close the peer connection before looping again.
-			if err := pc.Close(); err != nil {
-				slog.Error("failed to close peer connection", "err", err)
-			}
+				if offer.Session != "" {
+					sessions.Write(func(m map[string]*webrtc.PeerConnection) { m[offer.Session] = pc })
+				}
+				// Stripe groups are scoped to the session the others are bonded
+				// to, so that a group only collects the channels of one client.
+				owner := offer.Session
+				if offer.Bond != "" {
+					owner = offer.Bond
+				}
+				shaper := limits
+				shaper.Scheduler = common.NewScheduler()
+				if err := serve(ctx, pc, chC, closed, striped, owner, shaper, localAddr, protocol, opts); err != nil && ctx.Err() == nil {
+					slog.Error("session failed", "session", offer.Session, "err", err)
+				}
+
+				if offer.Session != "" {
+					sessions.Write(func(m map[string]*webrtc.PeerConnection) { delete(m, offer.Session) })
+				}
+				// The connection is done, close the peer connection.
+				if err := pc.Close(); err != nil {
+					slog.Error("failed to close peer connection", "err", err)
+				}
+			}(offer)
 		}
 	}()
 
 	return ec
 }
+
+// answer answers offer on pc and sends the answer back through the signaling
+// server. It is used both for new peer connections and for ICE restarts.
+func answer(ctx context.Context, hc *resty.Client, id string, pc *webrtc.PeerConnection, offer common.RTCSignal, opts Options) error {
+	slog.Debug("setting remote description")
+	if err := answerer.B_SetOfferAsRemoteDescription(pc, offer.SessionDescription); err != nil {
+		slog.Error("set remote description error", "err", err)
+		return err
+	}
+
+	answerO := webrtc.AnswerOptions{}
+	slog.Debug("creating answer")
+	answer, err := answerer.C_CreateAnswer(pc, answerO)
+	if err != nil {
+		slog.Error("create answer error", "err", err)
+		return err
+	}
+	slog.Debug("setting local description")
+	if err := answerer.D_SetAnswerAsLocalDescription(pc, *answer); err != nil {
+		slog.Error("set local description error", "err", err)
+		return err
+	}
+
+	if err := rtc.Gather(ctx, pc, opts.Timeouts.Gather); err != nil {
+		slog.Error("gather candidates error", "err", err)
+		return err
+	}
+	ld, err := rtc.LocalSignal(pc, opts.ICE.Privacy)
+	if err != nil {
+		slog.Error("local description error", "err", err)
+		return err
+	}
+	ld.Session = offer.Session
+	ld.Codecs = opts.Codecs
+	ld.PersistentCert = opts.Certificate != ""
+
+	sctx, cancel := rtc.WithTimeout(ctx, opts.Timeouts.Signal)
+	defer cancel()
+
+	slog.Debug("sending answer")
+	if err := rtc.SendRTCEvent(sctx, hc, common.RTCAnswerType, id, ld); err != nil {
+		slog.Error("send answer error", "err", err)
+		return rtc.PhaseError("sending answer", opts.Timeouts.Signal, err)
+	}
+
+	return nil
+}
+
+// serve bridges the data channels of a session to the local service until
+// the session ends. A stream session has a control channel, whose closing ends
+// the session, and a data channel per client connection, each bridged to its
+// own connection to the local service, or striped with channels of other
+// sessions bonded to owner, or asking the host to listen. A packet session has a single data
+// channel. serve fails when the session cannot be established in time.
+func serve(ctx context.Context, pc *webrtc.PeerConnection, chC <-chan *common.Channel, closed <-chan struct{}, striped *stripes, owner string, shaper common.Shaper, localAddr string, protocol common.NetProtocol, opts Options) error {
+	slog.Debug("waiting for ICE connection")
+	if err := rtc.WaitConnected(ctx, pc, opts.Timeouts.ICE); err != nil {
+		return err
+	}
+
+	octx, cancel := rtc.WithTimeout(ctx, opts.Timeouts.Open)
+	defer cancel()
+
+	ended := make(chan error, 1)
+	for {
+		slog.Debug("waiting for data channel")
+		select {
+		case ch := <-chC:
+			// The session is established once its first channel arrived.
+			cancel()
+			octx = ctx
+
+			if ch.Label() == common.ControlLabel {
+				go func() {
+					select {
+					case <-ch.Opened():
+					case <-closed:
+						return
+					case <-ctx.Done():
+						return
+					}
+					if err := ch.Wait(); err != nil {
+						ended <- fmt.Errorf("control channel: %w", err)
+						return
+					}
+					slog.Debug("control channel closed")
+					ended <- nil
+				}()
+				continue
+			}
+			if spec, err := ch.Spec(); err == nil && spec.Listen != "" {
+				go func() {
+					err := listen(ctx, pc, ch, spec.Listen, closed, shaper, protocol, opts)
+					if !protocol.Stream() {
+						ended <- err
+					} else if err != nil {
+						slog.Error("remote listen failed", "addr", spec.Listen, "err", err)
+					}
+				}()
+				continue
+			}
+			chs := []*common.Channel{ch}
+			if spec, err := ch.Spec(); err == nil && spec.Group != "" && protocol.Stream() {
+				if chs = striped.add(owner, ch, spec); chs == nil {
+					// The rest of the stripes is still to come.
+					continue
+				}
+			}
+			go func() {
+				err := bridge(ctx, chs, closed, shaper, localAddr, protocol, opts)
+				if !protocol.Stream() {
+					ended <- err
+				} else if err != nil {
+					slog.Error("stream failed", "label", ch.Label(), "err", err)
+				}
+			}()
+		case err := <-ended:
+			return err
+		case <-closed:
+			return webrtc.ErrConnectionClosed
+		case <-octx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return rtc.PhaseError("data channel open", opts.Timeouts.Open, octx.Err())
+		}
+	}
+}
+
+// bridge waits for the channels of a stream, usually just one, to open and
+// bridges them to the local service, or to the target of their spec if the
+// allow-list allows it, until either side goes away. shaper is shared by the
+// streams of the peer connection.
+func bridge(ctx context.Context, chs []*common.Channel, closed <-chan struct{}, shaper common.Shaper, localAddr string, protocol common.NetProtocol, opts Options) error {
+	octx, cancel := rtc.WithTimeout(ctx, opts.Timeouts.Open)
+	defer cancel()
+
+	for _, ch := range chs {
+		slog.Debug("waiting for data channel to open", "label", ch.Label())
+		select {
+		case <-ch.Opened():
+		case <-closed:
+			return webrtc.ErrConnectionClosed
+		case <-octx.Done():
+			return rtc.PhaseError("data channel open", opts.Timeouts.Open, octx.Err())
+		}
+	}
+	cancel()
+
+	var ch common.MessageChannel = chs[0]
+	if len(chs) > 1 {
+		ch = common.NewStriped(chs)
+	}
+
+	spec, err := ch.Spec()
+	addr := localAddr
+	if err == nil && spec.Target != "" {
+		protocol = spec.Network
+		addr, err = opts.allow.resolve(ctx, spec.Target)
+		if err != nil {
+			err = fmt.Errorf("target %s: %w", spec.Target, err)
+		}
+	} else if err == nil && spec.Service != "" {
+		protocol, addr, err = opts.service(protocol, spec.Service)
+	} else if err == nil && addr == "" {
+		err = errors.New("no local service")
+	}
+	if err == nil && protocol.Stream() && spec.Codec != common.CodecNone && !slices.Contains(opts.Codecs, spec.Codec) {
+		err = fmt.Errorf("codec %q not accepted", spec.Codec)
+	}
+	if err != nil {
+		if protocol.Stream() {
+			common.RejectStream(ch, err)
+		} else {
+			ch.Close()
+		}
+		return err
+	}
+	slog.Info("start bridging", "protocol", protocol, "addr", addr, "label", ch.Label(), "stripes", len(chs))
+
+	var bridgeErrCh <-chan error
+	switch protocol {
+	case common.TCP, common.Unix:
+		conn, err := net.Dial(string(protocol), addr)
+		if err != nil {
+			common.RejectStream(ch, err)
+			return fmt.Errorf("host failed to dial %s: %w", addr, err)
+		}
+		shaper.Priority = spec.Priority
+		bridgeErrCh = common.BridgeStream(ch, conn, &shaper)
+	case common.UDP, common.Unixgram:
+		dial := func() (net.Conn, error) {
+			if protocol == common.Unixgram {
+				return common.DialUnixgram(addr, opts.socketMode())
+			}
+			return net.Dial("udp", addr)
+		}
+		bridgeErrCh = common.BridgeFlows(chs[0], dial, opts.Flows, &shaper)
+	}
+
+	// Wait for the bridge to finish
+	if err := <-bridgeErrCh; err != nil {
+		slog.Error("bridge finished with error", "label", ch.Label(), "err", err)
+	} else {
+		slog.Debug("bridge finished cleanly", "label", ch.Label())
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+
+	"wtt/common"
+	"wtt/common/rtc"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// errListenNotAllowed is the reason remote listens on addresses outside
+// Options.AllowListen are rejected with.
+var errListenNotAllowed = fmt.Errorf("listen address %w", common.ErrNotAllowed)
+
+// listen serves the remote listen ch asked for: it listens on addr and
+// bridges every connection accepted there over a new data channel it opens
+// on pc, which the client bridges to its own local service, until ch, the
+// session or ctx is done. In a packet session ch itself carries the flows of
+// the datagrams received on addr.
+func listen(ctx context.Context, pc *webrtc.PeerConnection, ch *common.Channel, addr string, closed <-chan struct{}, shaper common.Shaper, protocol common.NetProtocol, opts Options) error {
+	octx, cancel := rtc.WithTimeout(ctx, opts.Timeouts.Open)
+	defer cancel()
+	select {
+	case <-ch.Opened():
+	case <-closed:
+		return webrtc.ErrConnectionClosed
+	case <-octx.Done():
+		return rtc.PhaseError("data channel open", opts.Timeouts.Open, octx.Err())
+	}
+	cancel()
+
+	reject := func(err error) error {
+		if protocol.Stream() {
+			common.RejectStream(ch, err)
+		} else {
+			ch.Close()
+		}
+		return err
+	}
+	if !slices.Contains(opts.AllowListen, addr) {
+		return reject(fmt.Errorf("%s: %w", addr, errListenNotAllowed))
+	}
+
+	if !protocol.Stream() {
+		pconn, err := common.ListenPacket(protocol, addr, opts.socketMode())
+		if err != nil {
+			return reject(err)
+		}
+		slog.Info("listening for a client", "protocol", protocol, "addr", pconn.LocalAddr())
+		if err := <-common.BridgePacket(ch, pconn, opts.Flows, &shaper); err != nil {
+			slog.Error("udp bridge finished with error", "err", err)
+		}
+		return nil
+	}
+
+	l, err := common.Listen(protocol, addr, opts.socketMode())
+	if err != nil {
+		return reject(err)
+	}
+	defer l.Close()
+	if err := common.AcceptStream(ch); err != nil {
+		return err
+	}
+	slog.Info("listening for a client", "protocol", protocol, "addr", l.Addr())
+
+	go func() {
+		// Stop accepting once the client closed the listen or went away.
+		done := make(chan struct{})
+		go func() {
+			ch.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-closed:
+		case <-ctx.Done():
+		}
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-closed:
+				return webrtc.ErrConnectionClosed
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				slog.Info("remote listen closed", "addr", addr)
+				return nil
+			}
+			return fmt.Errorf("host failed to accept connection: %w", err)
+		}
+
+		go func() {
+			rch, err := openListenStream(ctx, pc, addr, closed, opts)
+			if err != nil {
+				slog.Error("failed to open stream", "err", err)
+				conn.Close()
+				return
+			}
+			slog.Info("start bridging", "protocol", protocol, "from", conn.RemoteAddr(), "label", rch.Label())
+			shaper := shaper
+			if err := <-common.BridgeStream(rch, conn, &shaper); err != nil {
+				slog.Error("bridge finished with error", "label", rch.Label(), "err", err)
+			} else {
+				slog.Debug("bridge finished cleanly", "label", rch.Label())
+			}
+		}()
+	}
+}
+
+// openListenStream opens the data channel of a connection accepted on the
+// remote listen addr and waits for it to open.
+func openListenStream(ctx context.Context, pc *webrtc.PeerConnection, addr string, closed <-chan struct{}, opts Options) (*common.Channel, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("create data channel label: %w", err)
+	}
+	protocol := common.ChannelSpec{Listen: addr}.Encode()
+	dc, err := pc.CreateDataChannel(id.String(), &webrtc.DataChannelInit{Protocol: &protocol})
+	if err != nil {
+		return nil, fmt.Errorf("create data channel: %w", err)
+	}
+	ch := common.NewChannel(dc)
+
+	octx, cancel := rtc.WithTimeout(ctx, opts.Timeouts.Open)
+	defer cancel()
+	select {
+	case <-ch.Opened():
+		return ch, nil
+	case <-closed:
+		return nil, webrtc.ErrConnectionClosed
+	case <-octx.Done():
+		ch.Close()
+		return nil, rtc.PhaseError("data channel open", opts.Timeouts.Open, octx.Err())
+	}
+}
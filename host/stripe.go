@@ -0,0 +1,77 @@
+package host
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"wtt/common"
+)
+
+// stripeTimeout is how long the channels of a striped stream may take to
+// arrive before the stream is given up.
+const stripeTimeout = 30 * time.Second
+
+// stripes collects the channels of striped streams. A client stripes a
+// stream over several peer connections, so its channels arrive on different
+// sessions, all bonded to the session that owns the group.
+type stripes struct {
+	mu     sync.Mutex
+	groups map[stripeGroup][]*common.Channel
+}
+
+// stripeGroup identifies a group by the session owning it and its name.
+type stripeGroup struct {
+	owner, name string
+}
+
+func newStripes() *stripes {
+	return &stripes{groups: map[stripeGroup][]*common.Channel{}}
+}
+
+// add adds ch, whose spec is spec, to its group of the sessions bonded to
+// owner. Once all channels of the group arrived it returns them in order.
+func (s *stripes) add(owner string, ch *common.Channel, spec common.ChannelSpec) []*common.Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := stripeGroup{owner: owner, name: spec.Group}
+	chs, ok := s.groups[group]
+	if !ok {
+		chs = make([]*common.Channel, spec.Stripes)
+		s.groups[group] = chs
+		time.AfterFunc(stripeTimeout, func() { s.expire(group) })
+	}
+	if len(chs) != spec.Stripes || chs[spec.Stripe] != nil {
+		slog.Warn("channel does not fit its stripe group, closing", "label", ch.Label(), "group", spec.Group)
+		ch.Close()
+		return nil
+	}
+	chs[spec.Stripe] = ch
+
+	for _, c := range chs {
+		if c == nil {
+			return nil
+		}
+	}
+	delete(s.groups, group)
+	return chs
+}
+
+// expire gives up group if it is still incomplete.
+func (s *stripes) expire(group stripeGroup) {
+	s.mu.Lock()
+	chs, ok := s.groups[group]
+	delete(s.groups, group)
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	slog.Warn("striped stream incomplete, closing", "group", group.name, "session", group.owner, "timeout", stripeTimeout)
+	for _, ch := range chs {
+		if ch != nil {
+			ch.Close()
+		}
+	}
+}
@@ -5,16 +5,63 @@ import (
 	"encoding/json"
 	"log/slog"
 	"net/http"
+	"sync"
+	"time"
 	"wtt/common"
 
 	"github.com/cornelk/hashmap"
 	"github.com/go-chi/chi/v5"
-	"github.com/pion/webrtc/v4"
 )
 
 type MessageChannel struct {
-	offer  chan webrtc.SessionDescription
-	answer chan webrtc.SessionDescription
+	offer chan common.RTCSignal
+	// answers queues answers by the session they belong to, so that a client
+	// only receives the answer to its own offer.
+	answers *answerQueues
+}
+
+// answerQueues holds the answer queue of every session with a request waiting
+// on it. A queue is dropped once no request waits on it anymore, so that
+// sessions whose client or host went away leave nothing behind.
+type answerQueues struct {
+	mu sync.Mutex
+	m  map[string]*answerQueue
+}
+
+type answerQueue struct {
+	c chan common.RTCSignal
+	// waiting counts the requests using c.
+	waiting int
+}
+
+func newAnswerQueues() *answerQueues {
+	return &answerQueues{m: map[string]*answerQueue{}}
+}
+
+// acquire returns the queue of answers for session. It must be released once
+// the request is done with it.
+func (q *answerQueues) acquire(session string) chan common.RTCSignal {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	a := q.m[session]
+	if a == nil {
+		a = &answerQueue{c: make(chan common.RTCSignal)}
+		q.m[session] = a
+	}
+	a.waiting++
+	return a.c
+}
+
+// release releases the queue of session, dropping it when no other request
+// waits on it.
+func (q *answerQueues) release(session string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if a := q.m[session]; a != nil {
+		if a.waiting--; a.waiting == 0 {
+			delete(q.m, session)
+		}
+	}
 }
 
 var hostM = hashmap.New[string, MessageChannel]()
@@ -60,9 +107,11 @@ func register(w http.ResponseWriter, r *http.Request) {
 
 	slog.Debug("received register message", "id", hostID)
 
-	hostM.Set(hostID, MessageChannel{
-		offer:  make(chan webrtc.SessionDescription),
-		answer: make(chan webrtc.SessionDescription),
+	// A host registering again keeps its queues, so that offers already
+	// waiting in them still reach it.
+	hostM.GetOrInsert(hostID, MessageChannel{
+		offer:   make(chan common.RTCSignal),
+		answers: newAnswerQueues(),
 	})
 
 	w.WriteHeader(http.StatusOK)
@@ -71,7 +120,7 @@ func register(w http.ResponseWriter, r *http.Request) {
 func receiveOffer(w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
 
-	var offer webrtc.SessionDescription
+	var offer common.RTCSignal
 	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
 		slog.Error("decode offer message error", "err", err)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -85,7 +134,12 @@ func receiveOffer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	c.offer <- offer
+	select {
+	case c.offer <- offer:
+	case <-r.Context().Done():
+		slog.Debug("offer abandoned", "id", hostID)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -100,7 +154,15 @@ func sendOffer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	offer := <-c.offer
+	var offer common.RTCSignal
+	select {
+	case offer = <-c.offer:
+	case <-time.After(common.PollHold):
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case <-r.Context().Done():
+		return
+	}
 
 	offerJ, err := json.Marshal(offer)
 	if err != nil {
@@ -116,13 +178,13 @@ func sendOffer(w http.ResponseWriter, r *http.Request) {
 func receiveAnswer(w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
 
-	var answer webrtc.SessionDescription
+	var answer common.RTCSignal
 	if err := json.NewDecoder(r.Body).Decode(&answer); err != nil {
 		slog.Error("decode answer message error", "err", err)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	slog.Debug("received answer message", "id", hostID)
+	slog.Debug("received answer message", "id", hostID, "session", answer.Session)
 
 	c, ok := hostM.Get(hostID)
 	if !ok {
@@ -130,13 +192,21 @@ func receiveAnswer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	c.answer <- answer
+	queue := c.answers.acquire(answer.Session)
+	defer c.answers.release(answer.Session)
+	select {
+	case queue <- answer:
+	case <-r.Context().Done():
+		slog.Debug("answer abandoned", "id", hostID, "session", answer.Session)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
 func sendAnswer(w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
+	session := r.URL.Query().Get("session")
 
 	c, ok := hostM.Get(hostID)
 	if !ok {
@@ -145,7 +215,18 @@ func sendAnswer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	answer := <-c.answer
+	queue := c.answers.acquire(session)
+	defer c.answers.release(session)
+
+	var answer common.RTCSignal
+	select {
+	case answer = <-queue:
+	case <-time.After(common.PollHold):
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case <-r.Context().Done():
+		return
+	}
 
 	answerJ, err := json.Marshal(answer)
 	if err != nil {
@@ -154,6 +235,6 @@ func sendAnswer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	slog.Debug("sending answer", "id", hostID)
+	slog.Debug("sending answer", "id", hostID, "session", session)
 	w.Write(answerJ)
 }
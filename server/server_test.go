@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+	"wtt/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnswerQueues(t *testing.T) {
+	q := newAnswerQueues()
+
+	// A poll that times out leaves nothing behind.
+	q.acquire("a")
+	q.release("a")
+	require.Empty(t, q.m)
+
+	// An answer waiting across polls keeps its queue, and reaches the next
+	// poll.
+	sent := make(chan struct{})
+	c := q.acquire("b")
+	go func() {
+		defer close(sent)
+		defer q.release("b")
+		c <- common.RTCSignal{Session: "b"}
+	}()
+	q.acquire("b")
+	q.release("b")
+	require.Len(t, q.m, 1)
+
+	answer := <-q.acquire("b")
+	require.Equal(t, "b", answer.Session)
+	q.release("b")
+	<-sent
+	require.Empty(t, q.m)
+}